@@ -0,0 +1,493 @@
+package orr
+
+// 批量操作
+// 使用pipeline将多个对象的读写合并为少数几次与redis的交互
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"reflect"
+	"strconv"
+)
+
+var (
+	ErrNotFound = errors.New("object not found.")
+)
+
+type batchItem struct {
+	name      string
+	rv        reflect.Value
+	idxkeys   []string
+	idxfields []string
+	id        int64
+	buf       []byte
+}
+
+// InsertMany批量插入对象, objs的每个元素都必须是struct的Ptr
+// 返回的ids, errs与objs一一对应, 插入失败的对象id为-1
+//
+// 与Insert相同, index字段的唯一性检查与辅助hashmap的写入都通过pipeline完成
+func InsertMany(objs []interface{}, index bool) ([]int64, []error) {
+	return InsertManyContext(context.Background(), objs, index)
+}
+
+// InsertManyContext与InsertMany相同, ctx用于传递操作者, 租户等信息
+func InsertManyContext(ctx context.Context, objs []interface{}, index bool) ([]int64, []error) {
+	var (
+		ids   = make([]int64, len(objs))
+		errs  = make([]error, len(objs))
+		items = make([]*batchItem, len(objs))
+		seen  = make(map[string]int)
+	)
+
+	// 使用客户端分片时对象可能在不同的分片中, 逐个插入
+	if sharded() {
+		for i, obj := range objs {
+			ids[i], errs[i] = -1, fmt.Errorf("param obj MUST be type Ptr.")
+			if obj != nil {
+				ids[i], errs[i] = InsertContext(ctx, obj, index)
+			}
+		}
+		return ids, errs
+	}
+
+	tenant := TenantFrom(ctx)
+	if tenant != "" {
+		if err := checkTenant(tenant); err != nil {
+			return ids, fillErrors(errs, err)
+		}
+	}
+
+	for i, obj := range objs {
+		ids[i] = -1
+		if obj == nil || reflect.TypeOf(obj).Kind() != reflect.Ptr {
+			errs[i] = fmt.Errorf("param obj MUST be type Ptr.")
+			continue
+		}
+		rvobj := reflect.ValueOf(obj).Elem()
+		rtobj := rvobj.Type()
+		if rtobj.Kind() != reflect.Struct {
+			errs[i] = fmt.Errorf("Param obj must be struct type.")
+			continue
+		}
+		if err := getModel(rtobj).checkName(); err != nil {
+			errs[i] = err
+			continue
+		}
+		if err := getModel(rtobj).prepareInsert(rvobj); err != nil {
+			errs[i] = err
+			continue
+		}
+		if err := beforeInsert(obj); err != nil {
+			errs[i] = err
+			continue
+		}
+		if err := getModel(rtobj).validate(rvobj); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		item := &batchItem{name: getModel(rtobj).scoped(tenant).name, rv: rvobj}
+		idxkeys, idxfields, err := indexFields(rvobj, rtobj, item.name, index)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		// 同一批次中的index值也不能重复
+		for j := 0; j < len(idxkeys); j++ {
+			k := idxkeys[j] + "\x00" + idxfields[j]
+			if prev, ok := seen[k]; ok {
+				err = fmt.Errorf("field %s has duplicate value %s with obj %d.",
+					idxkeys[j], idxfields[j], prev)
+				break
+			}
+			seen[k] = i
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		item.idxkeys, item.idxfields = idxkeys, idxfields
+		items[i] = item
+	}
+
+	conn := rpool.Get()
+	defer conn.Close()
+
+	// 第一次交互: 检查index字段的唯一性
+	// 命令发送失败时(如集群中的key不在同一个slot)该对象失败, 只读取已发送命令的返回
+	n := 0
+	sent := make([]int, len(items))
+	for i, item := range items {
+		if item == nil {
+			continue
+		}
+		for j := 0; j < len(item.idxkeys); j++ {
+			if err := conn.Send("HEXISTS", item.idxkeys[j], item.idxfields[j]); err != nil {
+				errs[i] = err
+				break
+			}
+			sent[i]++
+			n++
+		}
+	}
+	if n > 0 {
+		if err := conn.Flush(); err != nil {
+			return ids, fillErrors(errs, err)
+		}
+	}
+	for i, item := range items {
+		if item == nil {
+			continue
+		}
+		for j := 0; j < sent[i]; j++ {
+			exist, err := conn.Receive()
+			if err != nil {
+				if errs[i] == nil {
+					errs[i] = err
+				}
+			} else if exist.(int64) == 1 && errs[i] == nil {
+				errs[i] = fmt.Errorf("field %s has exist value %s.",
+					item.idxkeys[j], item.idxfields[j])
+			}
+		}
+		if errs[i] != nil {
+			items[i] = nil
+		}
+	}
+
+	// 第二次交互: 分配id, 每个对象的主hashmap, 创建时间zset及辅助索引在各自的事务中写入
+	n = 0
+	score := createdScore()
+	txs := make([]*tx, len(objs))
+	for i, item := range items {
+		if item == nil {
+			continue
+		}
+		m := getModel(item.rv.Type()).scoped(tenant)
+		item.id = NewId(item.name)
+		item.rv.FieldByName("Id").SetInt(item.id)
+		buf, err := m.encode(objs[i])
+		if err != nil {
+			ReturnId(item.name, item.id)
+			errs[i] = err
+			items[i] = nil
+			continue
+		}
+		item.buf = buf
+
+		sid := strconv.FormatInt(item.id, 10)
+		t := &tx{}
+		t.add("HSET", hashKey(item.name), sid, item.buf)
+		t.add("ZADD", createdKey(item.name), score, sid)
+		if m.ttl > 0 {
+			t.add("ZADD", expireKey(item.name), expireScore(m.ttl), sid)
+		}
+		if err = m.addIndexes(t, sid, item.rv); err == nil {
+			err = m.historyCommands(ctx, t, "insert", sid, reflect.Value{})
+		}
+		if err != nil {
+			ReturnId(item.name, item.id)
+			errs[i] = err
+			items[i] = nil
+			continue
+		}
+		changeCommand(t, item.name, sid, "insert", m.changedFields(reflect.Value{}, item.rv), item.buf)
+		txs[i] = t
+		// 发送失败时receive返回错误
+		t.send(conn)
+		n++
+	}
+	if n == 0 {
+		return ids, errs
+	}
+	if err := conn.Flush(); err != nil {
+		for _, item := range items {
+			if item != nil {
+				ReturnId(item.name, item.id)
+			}
+		}
+		return ids, fillErrors(errs, err)
+	}
+
+	for i, item := range items {
+		if item == nil {
+			continue
+		}
+		if _, err := txs[i].receive(conn); err != nil {
+			ReturnId(item.name, item.id)
+			errs[i] = err
+			continue
+		}
+		ids[i] = item.id
+		errs[i] = afterInsert(objs[i])
+	}
+
+	return ids, errs
+}
+
+// SelectMany通过HMGET一次读取多个对象
+// res必须为slice的Ptr, slice的元素为struct或struct的Ptr; res的长度与ids相同, 顺序一致
+// 返回的errs与ids一一对应, 对象不存在时为ErrNotFound
+func SelectMany(ids []int64, name string, res interface{}) ([]error, error) {
+	rtelem, isPtr, err := resultElem(res)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(ids))
+	slice := reflect.MakeSlice(reflect.TypeOf(res).Elem(), len(ids), len(ids))
+	reflect.ValueOf(res).Elem().Set(slice)
+	if len(ids) == 0 {
+		return errs, nil
+	}
+
+	// 使用客户端分片时对象可能在不同的分片中, 逐个读取
+	if sharded() {
+		for i, id := range ids {
+			pv := reflect.New(rtelem)
+			if errs[i] = Select(id, name, pv.Interface()); errs[i] != nil {
+				continue
+			}
+			if isPtr {
+				slice.Index(i).Set(pv)
+			} else {
+				slice.Index(i).Set(pv.Elem())
+			}
+		}
+		return errs, nil
+	}
+
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, hashKey(name))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	conn := rpool.Get()
+	defer conn.Close()
+	conn.Send("HMGET", args...)
+	for _, id := range ids {
+		conn.Send("ZSCORE", expireKey(name), id)
+	}
+	all, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	replies, err := redis.Values(all[0], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, reply := range replies {
+		// 已过期但尚未被清理的对象视为不存在
+		if reply == nil || expired(all[i+1]) {
+			errs[i] = ErrNotFound
+			continue
+		}
+		v, err := decodeElem(reply.([]byte), rtelem, isPtr)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		slice.Index(i).Set(v)
+	}
+
+	return errs, nil
+}
+
+// DeleteMany批量删除对象, 删除主hashmap, 创建时间zset及辅助索引中的数据
+// 与Delete相同, 辅助索引根据redis中保存的数据删除, 所有对象在同一个事务中删除
+// 返回的errs与objs一一对应, 对象不存在时不作为错误; 重复的对象只删除一次
+func DeleteMany(objs []interface{}) []error {
+	return DeleteManyContext(context.Background(), objs)
+}
+
+// DeleteManyContext与DeleteMany相同, ctx用于传递操作者, 租户等信息
+func DeleteManyContext(ctx context.Context, objs []interface{}) []error {
+	var (
+		errs   = make([]error, len(objs))
+		models = make([]*model, len(objs))
+		sids   = make([]string, len(objs))
+		watch  []interface{}
+		seen   = make(map[string]bool)
+		first  = make(map[string]int) // 类型名:id第一次出现的位置
+		dups   = make(map[int]int)    // 重复的对象只删除一次, 返回与第一次出现时相同的结果
+	)
+
+	// 使用客户端分片时对象可能在不同的分片中, 逐个删除
+	if sharded() {
+		for i, obj := range objs {
+			errs[i] = fmt.Errorf("Param obj must be struct type.")
+			if obj != nil {
+				errs[i] = DeleteContext(ctx, obj)
+			}
+		}
+		return errs
+	}
+
+	tenant := TenantFrom(ctx)
+	if tenant != "" {
+		if err := checkTenant(tenant); err != nil {
+			return fillErrors(errs, err)
+		}
+	}
+
+	for i, obj := range objs {
+		if obj == nil {
+			errs[i] = fmt.Errorf("Param obj must be struct type.")
+			continue
+		}
+		rvobj := reflect.Indirect(reflect.ValueOf(obj))
+		if rvobj.Kind() != reflect.Struct {
+			errs[i] = fmt.Errorf("Param obj must be struct type.")
+			continue
+		}
+
+		if err := getModel(rvobj.Type()).checkName(); err != nil {
+			errs[i] = err
+			continue
+		}
+		m := getModel(rvobj.Type()).scoped(tenant)
+		sid := strconv.FormatInt(rvobj.FieldByName("Id").Int(), 10)
+		if j, ok := first[m.name+":"+sid]; ok {
+			dups[i] = j
+			continue
+		}
+		first[m.name+":"+sid] = i
+		models[i], sids[i] = m, sid
+		if !seen[models[i].name] {
+			seen[models[i].name] = true
+			watch = append(watch, hashKey(models[i].name))
+		}
+	}
+	if len(watch) == 0 {
+		return errs
+	}
+	// errs与返回值共用底层数组
+	defer func() {
+		for i, j := range dups {
+			errs[i] = errs[j]
+		}
+	}()
+
+	conn := rpool.Get()
+	defer conn.Close()
+	for retry := 0; ; retry++ {
+		if err := conn.Send("WATCH", watch...); err != nil {
+			return fillErrors(errs, err)
+		}
+		// 命令发送失败时(如集群中的key不在同一个slot)该对象失败, 只读取已发送命令的返回
+		sent := make([]bool, len(models))
+		for i, m := range models {
+			if m == nil {
+				continue
+			}
+			if err := conn.Send("HGET", hashKey(m.name), sids[i]); err != nil {
+				errs[i] = err
+				continue
+			}
+			sent[i] = true
+		}
+		if err := conn.Flush(); err != nil {
+			return fillErrors(errs, err)
+		}
+		if _, err := conn.Receive(); err != nil {
+			return fillErrors(errs, err)
+		}
+
+		// 每个对象的命令在事务中的范围
+		t := &tx{}
+		ranges := make([][2]int, len(objs))
+		for i, m := range models {
+			if m == nil || !sent[i] {
+				continue
+			}
+			reply, err := conn.Receive()
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			if reply == nil {
+				continue
+			}
+			old, _, err := m.decode(reply.([]byte))
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			ranges[i][0] = len(t.cmds)
+			if err = m.deleteCommands(ctx, t, sids[i], old); err != nil {
+				errs[i] = err
+				t.cmds = t.cmds[:ranges[i][0]]
+			}
+			ranges[i][1] = len(t.cmds)
+		}
+		if len(t.cmds) == 0 {
+			conn.Do("UNWATCH")
+			return errs
+		}
+
+		replies, err := t.exec(conn)
+		if err == errWatch && retry < maxWatchRetry {
+			continue
+		}
+		if replies == nil {
+			return fillErrors(errs, err)
+		}
+		for i, r := range ranges {
+			for j := r[0]; j < r[1]; j++ {
+				if e, ok := replies[j].(redis.Error); ok && errs[i] == nil {
+					errs[i] = e
+				}
+			}
+			if r[1] > r[0] && errs[i] == nil {
+				errs[i] = afterDelete(addressable(objs[i]))
+			}
+		}
+		return errs
+	}
+}
+
+// 将errs中尚未出错的项设置为err
+func fillErrors(errs []error, err error) []error {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// 检查res是否为slice的Ptr, 返回slice元素的struct类型, 以及元素是否为Ptr
+func resultElem(res interface{}) (reflect.Type, bool, error) {
+	rtres := reflect.TypeOf(res)
+	if rtres == nil || rtres.Kind() != reflect.Ptr || rtres.Elem().Kind() != reflect.Slice {
+		return nil, false, fmt.Errorf("param res must be Ptr of Slice.")
+	}
+	rtelem := rtres.Elem().Elem()
+	isPtr := rtelem.Kind() == reflect.Ptr
+	if isPtr {
+		rtelem = rtelem.Elem()
+	}
+	if rtelem.Kind() != reflect.Struct {
+		return nil, false, fmt.Errorf("element of param res must be struct or Ptr of struct.")
+	}
+	return rtelem, isPtr, nil
+}
+
+// 将buf解码为rtelem类型的值, isPtr为true时返回Ptr
+func decodeElem(buf []byte, rtelem reflect.Type, isPtr bool) (reflect.Value, error) {
+	pv := reflect.New(rtelem)
+	if err := decodeObject(buf, pv.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	if isPtr {
+		return pv, nil
+	}
+	return pv.Elem(), nil
+}
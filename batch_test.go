@@ -0,0 +1,79 @@
+package orr
+
+import (
+	"testing"
+)
+
+type Tbatch struct {
+	Id    int64
+	Name  string `orr:"index"`
+	Score int
+}
+
+type Tbatchcount struct {
+	Id    int64
+	Group string `orr:"count"`
+}
+
+func TestInsertMany(t *testing.T) {
+	objs := []interface{}{
+		&Tbatch{Name: "b1", Score: 1},
+		&Tbatch{Name: "b2", Score: 2},
+		&Tbatch{Name: "b1", Score: 3},
+		&Tbatch{Name: "b3", Score: 4},
+	}
+	ids, errs := InsertMany(objs, true)
+	if errs[0] != nil || errs[1] != nil || errs[3] != nil {
+		t.Fatal(errs)
+	}
+	if errs[2] == nil || ids[2] != -1 {
+		t.Fatal("duplicate index value should fail")
+	}
+
+	var res []*Tbatch
+	errs, err := SelectMany([]int64{ids[3], 100000, ids[0]}, "tbatch", &res)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if errs[0] != nil || errs[2] != nil || errs[1] != ErrNotFound {
+		t.Fatal(errs)
+	}
+	if res[0].Name != "b3" || res[1] != nil || res[2].Name != "b1" {
+		t.Fatal("SelectMany wrong data")
+	}
+
+	id, err := SelectIndex("tbatch", "name", "b2")
+	if err != nil || id != ids[1] {
+		t.Fatal("index of b2 is wrong")
+	}
+
+	errs = DeleteMany([]interface{}{objs[0], objs[1], objs[3]})
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	errs, _ = SelectMany(ids, "tbatch", &res)
+	for _, err := range errs {
+		if err != ErrNotFound {
+			t.Fatal("DeleteMany failed")
+		}
+	}
+}
+
+func TestDeleteManyDuplicate(t *testing.T) {
+	objs := []interface{}{&Tbatchcount{Group: "g"}, &Tbatchcount{Group: "g"}}
+	if _, errs := InsertMany(objs, false); errs[0] != nil || errs[1] != nil {
+		t.Fatal(errs)
+	}
+	defer DeleteMany(objs)
+
+	errs := DeleteMany([]interface{}{objs[0], objs[0]})
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatal(errs)
+	}
+	counts, err := CountsBy("tbatchcount", "group")
+	if err != nil || counts["g"] != 1 {
+		t.Fatal("repeated object should be deleted once", counts)
+	}
+}
@@ -0,0 +1,111 @@
+package orr
+
+// bitmap索引
+//
+// tag为bitmap的bool字段保存在bitmap(结构名_字段名:bitmap)中, 以obj.Id为offset,
+// 字段值为true时该位为1. NewId分配的id是连续的正整数, bitmap的空间利用率较高.
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+)
+
+func bitmapKey(name string, fieldName string) string {
+	return redisKey(name, fieldSuffix(fieldName)+":bitmap")
+}
+
+// CountWhere返回类型name中字段field为true的对象数量
+func CountWhere(name, field string) (int64, error) {
+	return sumShards(func(conn redis.Conn) (int64, error) {
+		return redis.Int64(conn.Do("BITCOUNT", bitmapKey(name, field)))
+	})
+}
+
+// IdsWhere返回类型name中字段field为true的对象Id, 按Id升序
+func IdsWhere(name, field string) ([]int64, error) {
+	return mergeShards(func(conn redis.Conn) ([]int64, error) {
+		return bitmapIds(conn, bitmapKey(name, field))
+	})
+}
+
+// CountWhereAll返回所有字段都为true的对象数量
+func CountWhereAll(name string, fields ...string) (int64, error) {
+	return bitopCount("AND", name, fields)
+}
+
+// CountWhereAny返回任一字段为true的对象数量
+func CountWhereAny(name string, fields ...string) (int64, error) {
+	return bitopCount("OR", name, fields)
+}
+
+// IdsWhereAll返回所有字段都为true的对象Id, 按Id升序
+func IdsWhereAll(name string, fields ...string) ([]int64, error) {
+	return bitopIds("AND", name, fields)
+}
+
+// IdsWhereAny返回任一字段为true的对象Id, 按Id升序
+func IdsWhereAny(name string, fields ...string) ([]int64, error) {
+	return bitopIds("OR", name, fields)
+}
+
+// 对多个字段的bitmap执行BITOP, 结果保存在临时key中
+func bitop(conn redis.Conn, op string, name string, fields []string) (string, error) {
+	if len(fields) == 0 {
+		return "", fmt.Errorf("at least one field is required.")
+	}
+	dest := tmpKey(name)
+	args := []interface{}{op, dest}
+	for _, f := range fields {
+		args = append(args, bitmapKey(name, f))
+	}
+	conn.Send("BITOP", args...)
+	conn.Send("EXPIRE", dest, tmpKeyTTL)
+	return dest, receiveAll(conn, 2)
+}
+
+func bitopCount(op string, name string, fields []string) (int64, error) {
+	return sumShards(func(conn redis.Conn) (int64, error) {
+		dest, err := bitop(conn, op, name, fields)
+		defer conn.Do("DEL", dest)
+		if err != nil {
+			return 0, err
+		}
+		return redis.Int64(conn.Do("BITCOUNT", dest))
+	})
+}
+
+func bitopIds(op string, name string, fields []string) ([]int64, error) {
+	return mergeShards(func(conn redis.Conn) ([]int64, error) {
+		dest, err := bitop(conn, op, name, fields)
+		defer conn.Do("DEL", dest)
+		if err != nil {
+			return nil, err
+		}
+		return bitmapIds(conn, dest)
+	})
+}
+
+// 读取bitmap, 返回值为1的offset
+func bitmapIds(conn redis.Conn, key string) ([]int64, error) {
+	buf, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for i, b := range buf {
+		if b == 0 {
+			continue
+		}
+		// redis中offset 0为第一个字节的最高位
+		for j := 0; j < 8; j++ {
+			if b&(0x80>>uint(j)) != 0 {
+				ids = append(ids, int64(i*8+j))
+			}
+		}
+	}
+	return ids, nil
+}
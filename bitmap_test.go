@@ -0,0 +1,48 @@
+package orr
+
+import (
+	"testing"
+)
+
+type Tbitmap struct {
+	Id       int64
+	MainUser bool `orr:"bitmap"`
+	Approved bool `orr:"bitmap"`
+}
+
+func TestBitmap(t *testing.T) {
+	objs := []interface{}{
+		&Tbitmap{MainUser: true, Approved: true},
+		&Tbitmap{MainUser: true},
+		&Tbitmap{Approved: true},
+		&Tbitmap{},
+	}
+	ids, errs := InsertMany(objs, false)
+	if errs[0] != nil {
+		t.Fatal(errs[0].Error())
+	}
+	defer DeleteMany(objs)
+
+	if n, err := CountWhere("tbitmap", "MainUser"); err != nil || n != 2 {
+		t.Fatal("CountWhere MainUser should be 2")
+	}
+	res, err := IdsWhere("tbitmap", "approved")
+	if err != nil || len(res) != 2 || res[0] != ids[0] || res[1] != ids[2] {
+		t.Fatal("IdsWhere returns wrong ids", res)
+	}
+	if res, _ = IdsWhereAll("tbitmap", "MainUser", "Approved"); len(res) != 1 || res[0] != ids[0] {
+		t.Fatal("IdsWhereAll returns wrong ids", res)
+	}
+	if n, _ := CountWhereAny("tbitmap", "MainUser", "Approved"); n != 3 {
+		t.Fatal("CountWhereAny should be 3")
+	}
+
+	u := objs[1].(*Tbitmap)
+	u.MainUser = false
+	if err = Update(u, "tbitmap", u.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n, _ := CountWhere("tbitmap", "MainUser"); n != 1 {
+		t.Fatal("bitmap is not updated")
+	}
+}
@@ -0,0 +1,229 @@
+package orr
+
+// 变更流(change data capture)
+//
+// 通过EnableChangeStream开启后, Insert, Update, Delete, Save在写入对象的同一个事务中,
+// 向redis stream追加一条事件, 包含: type, id, op, fields(变化的字段名, json数组), payload.
+// payload为写入后的对象数据; Delete时为删除前的对象数据; Save时为保存的字段数据.
+//
+// 下游服务通过Consumer以consumer group的方式读取事件:
+//   c, _ := orr.NewConsumer("indexer", "worker-1")
+//   events, _ := c.Read(100, time.Second)
+//   for _, e := range events {
+//       var u Tuser
+//       e.Decode(&u)
+//       ...
+//       c.Ack(e.StreamId)
+//   }
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var changeStream struct {
+	key    string
+	maxLen int
+}
+
+// EnableChangeStream开启变更流, 事件写入stream key; maxLen大于0时stream的长度近似保持在maxLen之内
+// 应在程序启动时调用; stream key与类型的key不在同一个slot中, 因此集群模式下不能使用变更流;
+// 使用Shards时事件写入对象所在的分片, Consumer只读取第一个分片, 因此也不能使用变更流
+func EnableChangeStream(key string, maxLen int) error {
+	if key != "" {
+		switch rpool.(type) {
+		case *Cluster:
+			return fmt.Errorf("change stream is not supported in cluster mode.")
+		case *Shards:
+			return fmt.Errorf("change stream is not supported with shards.")
+		}
+	}
+	changeStream.key = key
+	changeStream.maxLen = maxLen
+	return nil
+}
+
+// Event为一次写操作的事件
+type Event struct {
+	StreamId string `json:",omitempty"` // 事件在stream中的id, Pub/Sub的通知没有该字段
+	Type     string
+	Id       int64
+	Op       string // insert, update, delete, undelete, save
+	Fields   []string
+	Payload  []byte // 编码后的对象数据, 通过Decode解码
+}
+
+// Decode将事件的payload解码到v
+func (e *Event) Decode(v interface{}) error {
+	if len(e.Payload) == 0 {
+		return fmt.Errorf("event %s has no payload.", e.StreamId)
+	}
+	return decodeObject(e.Payload, v)
+}
+
+// 写操作的事件: 开启变更流时追加到stream, 并通过Pub/Sub发布通知, 见notify.go
+// 命令在写操作的事务中执行, 因此只有写入成功时才会产生事件
+func changeCommand(t *tx, name string, sid string, op string, fields []string, payload []byte) {
+	notifyCommands(t, name, sid, op, fields, payload)
+	if changeStream.key == "" {
+		return
+	}
+	fbuf, _ := json.Marshal(fields)
+	args := []interface{}{changeStream.key}
+	if changeStream.maxLen > 0 {
+		args = append(args, "MAXLEN", "~", changeStream.maxLen)
+	}
+	args = append(args, "*", "type", name, "id", sid, "op", op, "fields", fbuf, "payload", payload)
+	t.add("XADD", args...)
+}
+
+// 对象由old变为rv时变化的字段名; old为无效值时返回所有字段
+// 未导出的字段不能调用Interface(), 不参与比较
+func (m *model) changedFields(old, rv reflect.Value) []string {
+	var fields []string
+	for _, f := range m.fields {
+		if m.typ.Field(f.index).PkgPath != "" {
+			continue
+		}
+		if old.IsValid() && rv.IsValid() &&
+			reflect.DeepEqual(old.Field(f.index).Interface(), rv.Field(f.index).Interface()) {
+			continue
+		}
+		fields = append(fields, f.name)
+	}
+	return fields
+}
+
+// Consumer以consumer group的方式读取变更流
+type Consumer struct {
+	stream string
+	group  string
+	name   string
+}
+
+// NewConsumer创建consumer group(如果不存在)并返回该group中名为name的consumer
+// 新创建的group从最新的事件开始读取
+func NewConsumer(group, name string) (*Consumer, error) {
+	if changeStream.key == "" {
+		return nil, fmt.Errorf("change stream is not enabled.")
+	}
+
+	conn := rpool.Get()
+	defer conn.Close()
+	_, err := conn.Do("XGROUP", "CREATE", changeStream.key, group, "$", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, err
+	}
+
+	return &Consumer{stream: changeStream.key, group: group, name: name}, nil
+}
+
+// Read读取最多count个新事件, 没有新事件时最多阻塞block; block为0时不阻塞
+// 读取的事件在Ack之前处于pending状态
+func (c *Consumer) Read(count int, block time.Duration) ([]Event, error) {
+	return c.read(count, block, ">")
+}
+
+// Pending重新读取该consumer已读取但尚未Ack的事件, 用于故障恢复后重放
+func (c *Consumer) Pending(count int) ([]Event, error) {
+	return c.read(count, 0, "0")
+}
+
+func (c *Consumer) read(count int, block time.Duration, start string) ([]Event, error) {
+	args := []interface{}{"GROUP", c.group, c.name}
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
+	if block > 0 && start == ">" {
+		args = append(args, "BLOCK", int64(block/time.Millisecond))
+	}
+	args = append(args, "STREAMS", c.stream, start)
+
+	conn := rpool.Get()
+	defer conn.Close()
+	reply, err := conn.Do("XREADGROUP", args...)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	streams, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	for _, s := range streams {
+		pair, err := redis.Values(s, nil)
+		if err != nil || len(pair) != 2 {
+			return nil, fmt.Errorf("unexpected XREADGROUP reply.")
+		}
+		entries, err := redis.Values(pair[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			e, err := parseEvent(entry)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// Ack确认事件已处理
+func (c *Consumer) Ack(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := []interface{}{c.stream, c.group}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	conn := rpool.Get()
+	defer conn.Close()
+	_, err := conn.Do("XACK", args...)
+	return err
+}
+
+// 解析stream中的一条记录: [id, [k1, v1, k2, v2, ...]]
+func parseEvent(entry interface{}) (Event, error) {
+	var e Event
+	pair, err := redis.Values(entry, nil)
+	if err != nil || len(pair) != 2 {
+		return e, fmt.Errorf("unexpected stream entry.")
+	}
+	e.StreamId, err = redis.String(pair[0], nil)
+	if err != nil {
+		return e, err
+	}
+	// 已被删除(XDEL/MAXLEN)的pending事件没有内容
+	if pair[1] == nil {
+		return e, nil
+	}
+	kvs, err := redis.StringMap(pair[1], nil)
+	if err != nil {
+		return e, err
+	}
+
+	e.Type = kvs["type"]
+	e.Op = kvs["op"]
+	if e.Id, err = strconv.ParseInt(kvs["id"], 10, 64); err != nil {
+		return e, err
+	}
+	if kvs["fields"] != "" {
+		if err = json.Unmarshal([]byte(kvs["fields"]), &e.Fields); err != nil {
+			return e, err
+		}
+	}
+	if kvs["payload"] != "" {
+		e.Payload = []byte(kvs["payload"])
+	}
+	return e, nil
+}
@@ -0,0 +1,97 @@
+package orr
+
+import (
+	"testing"
+)
+
+type Tchange struct {
+	Id    int64
+	Name  string `orr:"index"`
+	Score int
+}
+
+type Tchangeunexported struct {
+	Id    int64
+	Name  string
+	cache []int
+}
+
+func TestChangeStream(t *testing.T) {
+	if err := EnableChangeStream("orr:test:changes", 1000); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer EnableChangeStream("", 0)
+
+	c, err := NewConsumer("test", "c1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	u := &Tchange{Name: "change1", Score: 1}
+	if _, err = Insert(u, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	u.Score = 2
+	if err = Update(u, "tchange", u.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = Delete(u); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	events, err := c.Read(10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(events) != 3 {
+		t.Fatalf("should read 3 events, got %d", len(events))
+	}
+	ops := []string{"insert", "update", "delete"}
+	for i, e := range events {
+		if e.Type != "tchange" || e.Id != u.Id || e.Op != ops[i] {
+			t.Fatalf("event %d mismatch: %+v", i, e)
+		}
+	}
+	if len(events[0].Fields) != 3 {
+		t.Fatal("insert event should contain all fields")
+	}
+	if len(events[1].Fields) != 1 || events[1].Fields[0] != "Score" {
+		t.Fatal("update event should contain changed field Score")
+	}
+	var old Tchange
+	if err = events[2].Decode(&old); err != nil || old.Score != 2 {
+		t.Fatal("delete event should contain the deleted object")
+	}
+
+	// 未Ack的事件可以重放
+	pending, err := c.Pending(10)
+	if err != nil || len(pending) != 3 {
+		t.Fatal("3 events should be pending")
+	}
+	for _, e := range events {
+		if err = c.Ack(e.StreamId); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	pending, err = c.Pending(10)
+	if err != nil || len(pending) != 0 {
+		t.Fatal("no events should be pending after Ack")
+	}
+}
+
+func TestUpdateUnexportedField(t *testing.T) {
+	u := &Tchangeunexported{Name: "unexported1", cache: []int{1}}
+	if _, err := Insert(u, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	u.Name = "unexported2"
+	u.cache = []int{2}
+	if err := Update(u, "tchangeunexported", u.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	var got Tchangeunexported
+	if err := Select(u.Id, "tchangeunexported", &got); err != nil || got.Name != "unexported2" {
+		t.Fatal("update of struct with unexported field failed")
+	}
+	Delete(u)
+}
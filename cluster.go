@@ -0,0 +1,475 @@
+package orr
+
+// Redis Cluster
+//
+//   err := orr.OpenCluster("127.0.0.1:7000", "127.0.0.1:7001", "127.0.0.1:7002")
+//
+// Cluster根据CLUSTER SLOTS维护slot与master节点的对应关系, 按命令的key将连接路由到对应的节点,
+// 收到MOVED时更新slot表并重试, 收到ASK时向目标节点发送ASKING后重试.
+// pipeline及事务中的命令收到MOVED/ASK时只能更新slot表, Insert, Update, Delete及Save重试整个事务一次.
+//
+// orr的一次操作(事务, pipeline)使用同一个连接, 因此涉及的key必须在同一个slot中.
+// OpenCluster将key的命名设置为HashTagKeys, 类型的所有key都使用类型名作为hash tag:
+//   {tuser}, {tuser}_email, {tuser}:created, ...
+// 因此同一个类型(及同一个租户)的所有key在同一个slot中. 限制:
+//   DeleteMany等同时操作多个类型的函数, 多个类型的key可能不在同一个slot中;
+//   EnableChangeStream的stream key与类型的key不在同一个slot中, 集群模式下不能使用变更流,
+//   EnableChangeStream及OpenCluster返回错误.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clusterSlots = 16384
+	// MOVED, ASK时最多重试的次数
+	maxRedirects = 5
+)
+
+var errCrossSlot = errors.New("keys of one operation must be in the same cluster slot.")
+
+// HashTagKeys返回使用hash tag的KeyNamer, 类型名(包括前缀)作为hash tag
+func HashTagKeys(prefix string) KeyNamer {
+	return KeyNamerFunc(func(name, suffix string) string {
+		return "{" + prefix + name + "}" + suffix
+	})
+}
+
+type Cluster struct {
+	mu    sync.RWMutex
+	seeds []string
+	slots [clusterSlots]string // slot对应的master节点地址
+	pools map[string]*redis.Pool
+
+	// Dial创建到节点的连接, 默认为redis.Dial("tcp", addr)
+	Dial func(addr string) (redis.Conn, error)
+}
+
+// NewCluster连接集群, addrs为部分节点的地址, 用于获取slot表
+func NewCluster(addrs ...string) (*Cluster, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("at least one cluster address is required.")
+	}
+	c := &Cluster{
+		seeds: addrs,
+		pools: make(map[string]*redis.Pool),
+		Dial: func(addr string) (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+	if err := c.Refresh(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// OpenCluster连接集群, 并使用HashTagKeys命名key
+func OpenCluster(addrs ...string) error {
+	if changeStream.key != "" {
+		return fmt.Errorf("change stream is not supported in cluster mode.")
+	}
+	c, err := NewCluster(addrs...)
+	if err != nil {
+		return err
+	}
+	rpool = c
+	SetKeyNamer(HashTagKeys(""))
+	return nil
+}
+
+func (c *Cluster) pool(addr string) *redis.Pool {
+	c.mu.RLock()
+	p, ok := c.pools[addr]
+	c.mu.RUnlock()
+	if ok {
+		return p
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok = c.pools[addr]; ok {
+		return p
+	}
+	p = &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 600 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return c.Dial(addr)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+	c.pools[addr] = p
+	return p
+}
+
+// Refresh从任一可用的节点重新读取slot表
+func (c *Cluster) Refresh() error {
+	c.mu.RLock()
+	addrs := append([]string{}, c.seeds...)
+	for addr := range c.pools {
+		addrs = append(addrs, addr)
+	}
+	c.mu.RUnlock()
+
+	var err error
+	for _, addr := range addrs {
+		conn := c.pool(addr).Get()
+		var reply []interface{}
+		reply, err = redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err == nil {
+			return c.setSlots(reply)
+		}
+	}
+	return fmt.Errorf("refresh cluster slots failed: %v", err)
+}
+
+// 解析CLUSTER SLOTS的返回: [[start, end, [ip, port, id], replicas...], ...]
+func (c *Cluster) setSlots(reply []interface{}) error {
+	var slots [clusterSlots]string
+	for _, item := range reply {
+		r, err := redis.Values(item, nil)
+		if err != nil || len(r) < 3 {
+			return fmt.Errorf("unexpected CLUSTER SLOTS reply.")
+		}
+		start, _ := redis.Int(r[0], nil)
+		end, _ := redis.Int(r[1], nil)
+		node, err := redis.Values(r[2], nil)
+		if err != nil || len(node) < 2 {
+			return fmt.Errorf("unexpected CLUSTER SLOTS reply.")
+		}
+		ip, _ := redis.String(node[0], nil)
+		port, _ := redis.Int(node[1], nil)
+		addr := ip + ":" + strconv.Itoa(port)
+		for s := start; s <= end && s < clusterSlots; s++ {
+			slots[s] = addr
+		}
+	}
+
+	c.mu.Lock()
+	c.slots = slots
+	c.mu.Unlock()
+	return nil
+}
+
+// 保存slot的节点地址
+func (c *Cluster) addrOf(slot int) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if addr := c.slots[slot]; addr != "" {
+		return addr
+	}
+	return c.seeds[0]
+}
+
+// Masters返回所有master节点的地址
+func (c *Cluster) Masters() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, addr := range c.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// Get返回按key路由的连接
+func (c *Cluster) Get() redis.Conn {
+	return &clusterConn{c: c}
+}
+
+// 返回所有master节点的连接, 用于SCAN等需要遍历所有节点的命令
+func (c *Cluster) nodeConns() []redis.Conn {
+	var conns []redis.Conn
+	for _, addr := range c.Masters() {
+		conns = append(conns, c.pool(addr).Get())
+	}
+	return conns
+}
+
+func (c *Cluster) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.pools {
+		p.Close()
+	}
+	c.pools = make(map[string]*redis.Pool)
+	return nil
+}
+
+// clusterConn在第一个带key的命令时绑定到该key所在的节点,
+// 之后的命令都发送到该节点; 没有未读取的返回且不在事务中时, 可以切换到其他节点
+type clusterConn struct {
+	c       *Cluster
+	conn    redis.Conn
+	addr    string
+	queued  []command // 空闲时Send的不带key的命令, 如MULTI, 绑定节点时发送
+	pending int       // 已Send尚未Receive的命令数
+	multi   bool
+	watch   bool
+	stale   bool // 收到过MOVED/ASK, slot表需要更新
+	err     error
+}
+
+func (cc *clusterConn) Close() error {
+	if cc.conn == nil {
+		return nil
+	}
+	err := cc.conn.Close()
+	cc.conn = nil
+	return err
+}
+
+func (cc *clusterConn) Err() error {
+	if cc.err != nil {
+		return cc.err
+	}
+	if cc.conn != nil {
+		return cc.conn.Err()
+	}
+	return nil
+}
+
+// 没有未读取的返回且不在事务中
+func (cc *clusterConn) idle() bool {
+	return cc.pending == 0 && !cc.multi && !cc.watch
+}
+
+// 连接到addr, 已连接到其他节点时, 只有空闲时才能切换; 之后发送暂存的命令
+func (cc *clusterConn) bind(addr string) error {
+	if cc.conn == nil || cc.addr != addr {
+		if cc.conn != nil {
+			if !cc.idle() {
+				return errCrossSlot
+			}
+			cc.conn.Close()
+		}
+		cc.conn = cc.c.pool(addr).Get()
+		cc.addr = addr
+	}
+	queued := cc.queued
+	cc.queued = nil
+	for _, q := range queued {
+		if err := cc.send(q.name, q.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 按命令的key选择节点; 不带key的命令使用已绑定的节点
+func (cc *clusterConn) route(cmd string, args []interface{}) error {
+	if cc.stale && cc.idle() {
+		cc.stale = false
+		cc.c.Refresh()
+	}
+	if key, ok := commandKey(cmd, args); ok {
+		return cc.bind(cc.c.addrOf(Slot(key)))
+	}
+	if cc.conn == nil {
+		return cc.bind(cc.c.addrOf(0))
+	}
+	return cc.bind(cc.addr)
+}
+
+func (cc *clusterConn) track(cmd string) {
+	switch strings.ToUpper(cmd) {
+	case "MULTI":
+		cc.multi = true
+	case "WATCH":
+		cc.watch = true
+	case "EXEC", "DISCARD":
+		cc.multi, cc.watch = false, false
+	case "UNWATCH":
+		cc.watch = false
+	}
+}
+
+func (cc *clusterConn) send(cmd string, args ...interface{}) error {
+	cc.pending++
+	cc.track(cmd)
+	return cc.conn.Send(cmd, args...)
+}
+
+func (cc *clusterConn) Send(cmd string, args ...interface{}) error {
+	// 空闲时不带key的命令(如MULTI)暂存, 由之后第一个带key的命令决定节点
+	if _, ok := commandKey(cmd, args); !ok && (cc.conn == nil || cc.idle()) {
+		cc.queued = append(cc.queued, command{cmd, args})
+		return nil
+	}
+	if err := cc.route(cmd, args); err != nil {
+		return err
+	}
+	return cc.send(cmd, args...)
+}
+
+func (cc *clusterConn) Flush() error {
+	if cc.conn == nil && len(cc.queued) == 0 {
+		return nil
+	}
+	if len(cc.queued) > 0 {
+		if err := cc.route("", nil); err != nil {
+			return err
+		}
+	}
+	return cc.conn.Flush()
+}
+
+func (cc *clusterConn) Receive() (interface{}, error) {
+	if cc.conn == nil {
+		return nil, fmt.Errorf("no pending reply.")
+	}
+	reply, err := cc.conn.Receive()
+	if cc.pending > 0 {
+		cc.pending--
+	}
+	if redirected(err) {
+		// pipeline中的命令无法重试, 下次绑定节点前更新slot表, 由调用者重试
+		cc.stale = true
+	}
+	return reply, err
+}
+
+func (cc *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		if cc.conn == nil && len(cc.queued) == 0 {
+			return nil, nil
+		}
+		if err := cc.Flush(); err != nil {
+			return nil, err
+		}
+		cc.pending = 0
+		return cc.conn.Do("")
+	}
+
+	if err := cc.route(cmd, args); err != nil {
+		return nil, err
+	}
+	// WATCH返回错误时没有生效, 恢复之前的状态以便切换节点
+	watch := cc.watch
+	cc.track(cmd)
+	reply, err := cc.conn.Do(cmd, args...)
+	cc.pending = 0
+	if _, ok := err.(redis.Error); ok && strings.ToUpper(cmd) == "WATCH" {
+		cc.watch = watch
+	}
+
+	// 事务中的命令不能重定向
+	for i := 0; i < maxRedirects && !cc.multi; i++ {
+		ask, addr, ok := redirect(err)
+		if !ok {
+			break
+		}
+		if ask {
+			// WATCH只对当前连接有效, 不能在其他连接上执行
+			if strings.ToUpper(cmd) == "WATCH" {
+				break
+			}
+			conn := cc.c.pool(addr).Get()
+			conn.Send("ASKING")
+			reply, err = conn.Do(cmd, args...)
+			conn.Close()
+			continue
+		}
+		cc.c.Refresh()
+		if cc.watch {
+			break
+		}
+		if err = cc.bind(addr); err != nil {
+			return nil, err
+		}
+		cc.track(cmd)
+		reply, err = cc.conn.Do(cmd, args...)
+	}
+	return reply, err
+}
+
+// 解析MOVED及ASK错误: MOVED 3999 127.0.0.1:6381
+func redirect(err error) (ask bool, addr string, ok bool) {
+	e, isRedis := err.(redis.Error)
+	if !isRedis {
+		return false, "", false
+	}
+	parts := strings.Fields(string(e))
+	if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+		return false, "", false
+	}
+	return parts[0] == "ASK", parts[2], true
+}
+
+// err是否为MOVED或ASK错误, 集群在迁移slot, 调用者可以重试
+func redirected(err error) bool {
+	_, _, ok := redirect(err)
+	return ok
+}
+
+// 命令的第一个key
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	switch strings.ToUpper(cmd) {
+	case "MULTI", "EXEC", "DISCARD", "UNWATCH", "PING", "ASKING", "SCAN",
+		"PUBLISH", "SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE", "CLUSTER":
+		return "", false
+	case "BITOP", "XGROUP":
+		return argString(args, 1)
+	case "XREADGROUP", "XREAD":
+		for i, arg := range args {
+			if s, ok := arg.(string); ok && strings.ToUpper(s) == "STREAMS" {
+				return argString(args, i+1)
+			}
+		}
+		return "", false
+	}
+	return argString(args, 0)
+}
+
+func argString(args []interface{}, i int) (string, bool) {
+	if i >= len(args) {
+		return "", false
+	}
+	switch v := args[i].(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return fmt.Sprint(args[i]), true
+}
+
+// Slot返回key所在的slot, key包含hash tag时只计算hash tag
+func Slot(key string) int {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// CRC16-CCITT(XMODEM)
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
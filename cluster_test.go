@@ -0,0 +1,422 @@
+package orr
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Tcluster struct {
+	Id    int64
+	Name  string
+	Email string `orr:"index"`
+}
+
+type Tclusterb struct {
+	Id    int64
+	Email string `orr:"index"`
+}
+
+// 两个节点都连接测试用的redis, tclusterb的slot属于n2, 其他slot属于n1
+func testCluster() *Cluster {
+	c := &Cluster{
+		seeds: []string{"n1"},
+		pools: make(map[string]*redis.Pool),
+		Dial: func(addr string) (redis.Conn, error) {
+			return redis.Dial("tcp", "127.0.0.1:6379")
+		},
+	}
+	for i := range c.slots {
+		c.slots[i] = "n1"
+	}
+	c.slots[Slot("{tclusterb}")] = "n2"
+	return c
+}
+
+func TestSlot(t *testing.T) {
+	if s := Slot("123456789"); s != 12739 {
+		t.Fatal(fmt.Sprintf("slot of 123456789 should be 12739, but is %d", s))
+	}
+	if Slot("{tuser}_email") != Slot("tuser") || Slot("{tuser}:created") != Slot("tuser") {
+		t.Fatal("keys with the same hash tag should be in the same slot")
+	}
+	if Slot("{}tuser") != int(crc16("{}tuser")%clusterSlots) {
+		t.Fatal("empty hash tag should be ignored")
+	}
+
+	namer := HashTagKeys("app:")
+	if k := namer.Key("tuser", "_email"); k != "{app:tuser}_email" {
+		t.Fatal("unexpected hash tag key: " + k)
+	}
+
+	if k, ok := commandKey("XREADGROUP", []interface{}{"GROUP", "g", "c", "STREAMS", "s", ">"}); !ok || k != "s" {
+		t.Fatal("XREADGROUP key should be the stream")
+	}
+	if _, ok := commandKey("MULTI", nil); ok {
+		t.Fatal("MULTI has no key")
+	}
+	if ask, addr, ok := redirect(redis.Error("MOVED 3999 127.0.0.1:7001")); !ok || ask || addr != "127.0.0.1:7001" {
+		t.Fatal("MOVED should be parsed")
+	}
+	if ask, _, ok := redirect(redis.Error("ASK 3999 127.0.0.1:7001")); !ok || !ask {
+		t.Fatal("ASK should be parsed")
+	}
+}
+
+// 启动3个master节点的集群, 需要redis-server
+func startCluster(t *testing.T) ([]string, func()) {
+	bin, err := exec.LookPath("redis-server")
+	if err != nil {
+		t.Skip("redis-server not found")
+	}
+	dir, err := os.MkdirTemp("", "orr-cluster")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var (
+		addrs []string
+		cmds  []*exec.Cmd
+	)
+	stop := func() {
+		for _, cmd := range cmds {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+		os.RemoveAll(dir)
+	}
+	for i := 0; i < 3; i++ {
+		port := 17000 + i
+		cmd := exec.Command(bin, "--port", fmt.Sprint(port), "--cluster-enabled", "yes",
+			"--cluster-config-file", filepath.Join(dir, fmt.Sprintf("nodes-%d.conf", port)),
+			"--dir", dir, "--save", "", "--appendonly", "no")
+		if err = cmd.Start(); err != nil {
+			stop()
+			t.Fatal(err.Error())
+		}
+		cmds = append(cmds, cmd)
+		addrs = append(addrs, fmt.Sprintf("127.0.0.1:%d", port))
+	}
+
+	// 分配slot, 并让节点互相发现
+	per := clusterSlots / len(addrs)
+	for i, addr := range addrs {
+		var conn redis.Conn
+		for retry := 0; retry < 50; retry++ {
+			if conn, err = redis.Dial("tcp", addr); err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err != nil {
+			stop()
+			t.Fatal(err.Error())
+		}
+		end := (i+1)*per - 1
+		if i == len(addrs)-1 {
+			end = clusterSlots - 1
+		}
+		args := []interface{}{"ADDSLOTSRANGE", i * per, end}
+		if _, err = conn.Do("CLUSTER", args...); err != nil {
+			stop()
+			t.Fatal(err.Error())
+		}
+		if i > 0 {
+			conn.Do("CLUSTER", "MEET", "127.0.0.1", 17000)
+		}
+		conn.Close()
+	}
+
+	// 等待集群状态为ok
+	for retry := 0; retry < 100; retry++ {
+		ok := true
+		for _, addr := range addrs {
+			conn, _ := redis.Dial("tcp", addr)
+			info, _ := redis.String(conn.Do("CLUSTER", "INFO"))
+			conn.Close()
+			if !strings.Contains(info, "cluster_state:ok") {
+				ok = false
+			}
+		}
+		if ok {
+			return addrs, stop
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	stop()
+	t.Fatal("cluster is not ready")
+	return nil, nil
+}
+
+func TestCluster(t *testing.T) {
+	addrs, stop := startCluster(t)
+	defer stop()
+
+	saved := rpool
+	defer func() {
+		rpool = saved
+		SetKeyNamer(nil)
+	}()
+	if err := OpenCluster(addrs...); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rpool.(*Cluster).Close()
+	if len(rpool.(*Cluster).Masters()) != 3 {
+		t.Fatal("cluster should have 3 masters")
+	}
+
+	var ids []int64
+	for i := 0; i < 10; i++ {
+		u := &Tcluster{Name: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("u%d@example.com", i)}
+		id, err := Insert(u, true)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ids = append(ids, id)
+	}
+	if _, err := Insert(&Tcluster{Email: "u1@example.com"}, true); err == nil {
+		t.Fatal("unique index should work in cluster")
+	}
+
+	var u Tcluster
+	if err := Select(ids[3], "tcluster", &u); err != nil || u.Name != "user3" {
+		t.Fatal("select in cluster failed")
+	}
+	if id, err := SelectIndex("tcluster", "email", "u5@example.com"); err != nil || id != ids[5] {
+		t.Fatal("select index in cluster failed")
+	}
+	u.Name = "changed"
+	if err := Update(&u, "tcluster", u.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Delete(&u); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Select(ids[3], "tcluster", &u); err != ErrNotFound {
+		t.Fatal("deleted object should not be found")
+	}
+
+	s, _ := ForTenant("acme")
+	if _, err := s.Insert(&Tcluster{Email: "u1@example.com"}, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := DropTenant("acme"); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestClusterCrossSlot(t *testing.T) {
+	saved := rpool
+	defer func() {
+		rpool = saved
+		SetKeyNamer(nil)
+	}()
+	c := testCluster()
+	defer c.Close()
+	rpool = c
+	SetKeyNamer(HashTagKeys(""))
+
+	if err := EnableChangeStream("orr:test:cluster", 0); err == nil {
+		t.Fatal("change stream should not be enabled in cluster mode")
+	}
+
+	// 不同slot的对象在同一个pipeline中, 发送失败的对象返回错误而不是阻塞
+	objs := []interface{}{
+		&Tcluster{Email: "a@cluster"},
+		&Tclusterb{Email: "b@cluster"},
+		&Tcluster{Email: "c@cluster"},
+	}
+	done := make(chan []error)
+	go func() {
+		_, errs := InsertMany(objs, true)
+		done <- errs
+	}()
+	var errs []error
+	select {
+	case errs = <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("InsertMany across slots blocked")
+	}
+	if errs[0] != nil || errs[2] != nil {
+		t.Fatal("objects in the same slot should be inserted")
+	}
+	if errs[1] == nil {
+		t.Fatal("object in another slot should fail")
+	}
+
+	go func() {
+		done <- DeleteMany(objs)
+	}()
+	select {
+	case errs = <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("DeleteMany across slots blocked")
+	}
+	if errs[1] == nil {
+		t.Fatal("object in another slot should fail")
+	}
+	for _, obj := range []interface{}{objs[0], objs[2]} {
+		Delete(obj)
+	}
+}
+
+// 模拟slot迁移: n1节点对事务中带key的命令返回MOVED, CLUSTER SLOTS返回所有slot都属于127.0.0.1:7001
+type movedConn struct {
+	redis.Conn
+	moved   bool
+	multi   bool
+	replies []interface{} // Send的命令的伪造返回, nil表示读取真实返回
+}
+
+func (mc *movedConn) Send(cmd string, args ...interface{}) error {
+	_, keyed := commandKey(cmd, args)
+	switch {
+	case strings.ToUpper(cmd) == "CLUSTER":
+		node := []interface{}{[]byte("127.0.0.1"), int64(7001)}
+		mc.replies = append(mc.replies, []interface{}{[]interface{}{int64(0), int64(clusterSlots - 1), node}})
+		return nil
+	case mc.moved && mc.multi && keyed:
+		mc.replies = append(mc.replies, redis.Error("MOVED 1 127.0.0.1:7001"))
+		return nil
+	}
+	switch strings.ToUpper(cmd) {
+	case "MULTI":
+		mc.multi = true
+	case "EXEC", "DISCARD":
+		mc.multi = false
+	}
+	mc.replies = append(mc.replies, nil)
+	return mc.Conn.Send(cmd, args...)
+}
+
+func (mc *movedConn) Receive() (interface{}, error) {
+	r := mc.replies[0]
+	mc.replies = mc.replies[1:]
+	switch v := r.(type) {
+	case nil:
+		return mc.Conn.Receive()
+	case redis.Error:
+		return nil, v
+	}
+	return r, nil
+}
+
+func (mc *movedConn) Do(cmd string, args ...interface{}) (reply interface{}, err error) {
+	if cmd != "" {
+		if err = mc.Send(cmd, args...); err != nil {
+			return nil, err
+		}
+	}
+	if err = mc.Flush(); err != nil {
+		return nil, err
+	}
+	// 与redigo相同, Do("")返回所有未读取的返回
+	var all []interface{}
+	for len(mc.replies) > 0 {
+		r, e := mc.Receive()
+		if e != nil && err == nil {
+			err = e
+		}
+		all = append(all, r)
+		reply = r
+	}
+	if cmd == "" {
+		return all, err
+	}
+	return reply, err
+}
+
+func TestClusterMoved(t *testing.T) {
+	saved := rpool
+	defer func() {
+		rpool = saved
+		SetKeyNamer(nil)
+	}()
+	c := &Cluster{
+		seeds: []string{"n1"},
+		pools: make(map[string]*redis.Pool),
+		Dial: func(addr string) (redis.Conn, error) {
+			conn, err := redis.Dial("tcp", "127.0.0.1:6379")
+			return &movedConn{Conn: conn, moved: addr == "n1"}, err
+		},
+	}
+	defer c.Close()
+	rpool = c
+	SetKeyNamer(HashTagKeys(""))
+	resetSlots := func() {
+		c.mu.Lock()
+		for i := range c.slots {
+			c.slots[i] = "n1"
+		}
+		c.mu.Unlock()
+	}
+
+	// 事务收到MOVED时更新slot表并重试
+	resetSlots()
+	u := &Tcluster{Name: "moved", Email: "moved@cluster"}
+	if _, err := Insert(u, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	if c.addrOf(Slot("{tcluster}")) != "127.0.0.1:7001" {
+		t.Fatal("slots should be refreshed after MOVED")
+	}
+
+	resetSlots()
+	u.Name = "changed"
+	if err := Update(u, "tcluster", u.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	var v Tcluster
+	if err := Select(u.Id, "tcluster", &v); err != nil || v.Name != "changed" {
+		t.Fatal("Update should be retried after MOVED")
+	}
+
+	resetSlots()
+	if err := Delete(u); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Select(u.Id, "tcluster", &v); err != ErrNotFound {
+		t.Fatal("Delete should be retried after MOVED")
+	}
+}
+
+func TestClusterWatch(t *testing.T) {
+	saved := rpool
+	defer func() {
+		rpool = saved
+	}()
+	c := testCluster()
+	defer c.Close()
+	rpool = c
+
+	u := &Tcluster{Name: "watch", Email: "watch@example.com"}
+	if _, err := Insert(u, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer Delete(u)
+
+	for i := 0; i < 10; i++ {
+		events, stop := Watch("tcluster", u.Id)
+		u.Name = fmt.Sprintf("watch%d", i)
+		if err := Update(u, "tcluster", u.Id); err != nil {
+			t.Fatal(err.Error())
+		}
+		select {
+		case e := <-events:
+			if e.Op != "update" || e.Id != u.Id {
+				t.Fatalf("unexpected event: %+v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Watch should receive the update in cluster")
+		}
+		// 停止订阅与读取通知的goroutine并发访问连接
+		stop()
+		for range events {
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package orr
+
+// 编码
+//
+// 对象及字段保存到redis之前通过Codec编码, 内置JSON, MsgPack, Gob及Protobuf.
+// 默认使用JSON, 通过SetCodec设置全局的Codec, 通过Register(obj, WithCodec(c))设置类型的Codec.
+//
+// JSON编码的数据不加标记, 与之前写入的数据兼容; 其他Codec编码的数据以一个字节的标记开始,
+// 读取时根据标记选择Codec, 因此切换Codec之后, 之前写入的数据仍然可以读取.
+// 编码后的数据可以再压缩, 见compress.go
+// 标记为Codec的Id, 取值范围为1~8, 不会与JSON数据的第一个字节冲突.
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/vmihailenco/msgpack"
+	"reflect"
+	"sync"
+)
+
+// 自定义Codec可用的Id范围
+const (
+	minCodecId = 1
+	maxCodecId = 8
+)
+
+type Codec interface {
+	// 写入数据的标记, 0表示不加标记, 仅JSON使用
+	Id() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSON     Codec = jsonCodec{}
+	MsgPack  Codec = msgpackCodec{}
+	Gob      Codec = gobCodec{}
+	Protobuf Codec = protoCodec{}
+)
+
+var codecs = struct {
+	sync.RWMutex
+	byId map[byte]Codec
+	def  Codec
+}{
+	byId: map[byte]Codec{
+		MsgPack.Id():  MsgPack,
+		Gob.Id():      Gob,
+		Protobuf.Id(): Protobuf,
+	},
+	def: JSON,
+}
+
+// SetCodec设置全局的Codec, 未通过WithCodec设置Codec的类型使用该Codec
+// c为nil时恢复为JSON
+func SetCodec(c Codec) error {
+	if c == nil {
+		c = JSON
+	}
+	if err := RegisterCodec(c); err != nil {
+		return err
+	}
+	codecs.Lock()
+	codecs.def = c
+	codecs.Unlock()
+	return nil
+}
+
+// WithCodec设置类型使用的Codec, Codec的Id已被其他Codec使用时Register返回错误
+func WithCodec(c Codec) Option {
+	return func(m *model) {
+		if err := RegisterCodec(c); err != nil {
+			m.err = err
+			return
+		}
+		m.codec = c
+	}
+}
+
+// RegisterCodec注册自定义的Codec, 读取时才能识别该Codec写入的数据
+// 使用SetCodec或WithCodec时自动注册
+func RegisterCodec(c Codec) error {
+	id := c.Id()
+	if id == 0 {
+		if c != JSON {
+			return fmt.Errorf("codec id 0 is reserved for JSON.")
+		}
+		return nil
+	}
+	if id < minCodecId || id > maxCodecId {
+		return fmt.Errorf("codec id must be between %d and %d.", minCodecId, maxCodecId)
+	}
+
+	codecs.Lock()
+	defer codecs.Unlock()
+	if old, ok := codecs.byId[id]; ok && old != c {
+		return fmt.Errorf("codec id %d has been registered.", id)
+	}
+	codecs.byId[id] = c
+	return nil
+}
+
+func defaultCodec() Codec {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	return codecs.def
+}
+
+// 类型使用的Codec
+func (m *model) getCodec() Codec {
+	if m.codec != nil {
+		return m.codec
+	}
+	return defaultCodec()
+}
+
+// 编码类型的对象或字段; 编码对象时先加密加密字段, 见encrypt.go
+func (m *model) encode(v interface{}) ([]byte, error) {
+	if rv := reflect.Indirect(reflect.ValueOf(v)); m.encrypted && rv.Type() == m.typ {
+		sealed, err := m.seal(rv)
+		if err != nil {
+			return nil, err
+		}
+		v = sealed.Addr().Interface()
+	}
+	return encodeValue(m.getCodec(), v)
+}
+
+// 按类型名返回Codec, 未注册的类型使用全局的Codec
+func codecOf(name string) Codec {
+	if m, ok := modelByName(name); ok {
+		return m.getCodec()
+	}
+	return defaultCodec()
+}
+
+// 使用c编码, 并在数据之前加上c的标记; 开启压缩时压缩编码后的数据, 见compress.go
+func encodeValue(c Codec, v interface{}) ([]byte, error) {
+	buf, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if c.Id() != 0 {
+		buf = append([]byte{c.Id()}, buf...)
+	}
+	return compress(buf)
+}
+
+// 解压后根据数据的标记选择Codec解码, 没有标记的数据为JSON
+func decodeValue(buf []byte, v interface{}) error {
+	buf, err := decompress(buf)
+	if err != nil {
+		return err
+	}
+	if len(buf) > 0 && buf[0] >= minCodecId && buf[0] <= maxCodecId {
+		codecs.RLock()
+		c, ok := codecs.byId[buf[0]]
+		codecs.RUnlock()
+		if !ok {
+			return fmt.Errorf("unknown codec %d.", buf[0])
+		}
+		return c.Unmarshal(buf[1:], v)
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// 解码对象到res, 解密加密字段并调用AfterLoad
+func decodeObject(buf []byte, res interface{}) error {
+	if err := decodeValue(buf, res); err != nil {
+		return err
+	}
+	if rv := reflect.Indirect(reflect.ValueOf(res)); rv.Kind() == reflect.Struct {
+		if err := getModel(rv.Type()).open(rv); err != nil {
+			return err
+		}
+	}
+	return afterLoad(res)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Id() byte { return 0 }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Id() byte { return 1 }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Id() byte { return 2 }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// protobuf只能编码proto.Message, 即protoc生成的struct的Ptr
+type protoCodec struct{}
+
+func (protoCodec) Id() byte { return 3 }
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not proto.Message.", v)
+	}
+	return proto.Marshal(msg)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not proto.Message.", v)
+	}
+	return proto.Unmarshal(data, msg)
+}
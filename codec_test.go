@@ -0,0 +1,98 @@
+package orr
+
+import (
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"reflect"
+	"testing"
+)
+
+type Tcodec struct {
+	Id       int64
+	Name     string `orr:"index"`
+	Big      int64
+	Messages map[string]string
+}
+
+type Tcodecswitch struct {
+	Id   int64
+	Name string
+}
+
+type Tcodecconflict struct {
+	Id   int64
+	Name string
+}
+
+// 与MsgPack的Id相同
+type conflictCodec struct{ jsonCodec }
+
+func (conflictCodec) Id() byte { return 1 }
+
+func TestCodec(t *testing.T) {
+	if err := Register(&Tcodec{}, WithCodec(MsgPack)); err != nil {
+		t.Fatal(err.Error())
+	}
+	c := &Tcodec{Name: "codec", Big: 1<<62 + 1, Messages: map[string]string{"a": "b"}}
+	if _, err := Insert(c, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	conn := rpool.Get()
+	defer conn.Close()
+	buf, _ := conn.Do("HGET", "tcodec", c.Id)
+	if b := buf.([]byte); len(b) == 0 || b[0] != MsgPack.Id() {
+		t.Fatal("data should be marked with msgpack codec")
+	}
+	var c2 Tcodec
+	if err := Select(c.Id, "tcodec", &c2); err != nil {
+		t.Fatal(err.Error())
+	}
+	if c2.Big != c.Big || c2.Messages["a"] != "b" {
+		t.Fatalf("msgpack round trip failed: %+v", c2)
+	}
+
+	// 切换Codec之后, 之前写入的数据仍然可以读取
+	old := &Tcodecswitch{Name: "json"}
+	if _, err := Insert(old, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := SetCodec(Gob); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer SetCodec(nil)
+	nw := &Tcodecswitch{Name: "gob"}
+	if _, err := Insert(nw, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	var res []Tcodecswitch
+	if errs, err := SelectMany([]int64{old.Id, nw.Id}, "tcodecswitch", &res); err != nil ||
+		errs[0] != nil || errs[1] != nil {
+		t.Fatal("SelectMany should read data written by both codecs")
+	}
+	if res[0].Name != "json" || res[1].Name != "gob" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	pb, err := encodeValue(Protobuf, &wrappers.StringValue{Value: "proto"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var sv wrappers.StringValue
+	if err = decodeValue(pb, &sv); err != nil || sv.Value != "proto" {
+		t.Fatal("protobuf round trip failed")
+	}
+	if _, err = encodeValue(Protobuf, c); err == nil {
+		t.Fatal("protobuf codec should reject non proto.Message")
+	}
+}
+
+func TestCodecConflict(t *testing.T) {
+	if err := Register(&Tcodecconflict{}, WithCodec(conflictCodec{})); err == nil {
+		t.Fatal("register with conflicting codec id should fail")
+	}
+	if getModel(reflect.TypeOf(Tcodecconflict{})).codec != nil {
+		t.Fatal("conflicting codec should not be used")
+	}
+	if err := Register(&Tcodecconflict{}); err != nil {
+		t.Fatal(err.Error())
+	}
+}
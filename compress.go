@@ -0,0 +1,183 @@
+package orr
+
+// 压缩
+//
+// 通过SetCompression开启后, 编码后的数据长度不小于threshold时压缩后再保存到redis,
+// 压缩的数据以一个字节的标记开始, 标记为Compressor的Id, 取值范围为16~31,
+// 不会与JSON数据及Codec的标记冲突. 读取时根据标记自动解压, 未压缩的数据及之前写入的数据不受影响.
+//
+//   orr.SetCompression(orr.Snappy, 4096)
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"sync"
+)
+
+// 自定义Compressor可用的Id范围
+const (
+	minCompressorId = 16
+	maxCompressorId = 31
+)
+
+type Compressor interface {
+	Id() byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	Gzip   Compressor = gzipCompressor{}
+	Snappy Compressor = snappyCompressor{}
+	Zstd   Compressor = &zstdCompressor{}
+)
+
+var compression = struct {
+	sync.RWMutex
+	byId      map[byte]Compressor
+	c         Compressor
+	threshold int
+}{
+	byId: map[byte]Compressor{
+		Gzip.Id():   Gzip,
+		Snappy.Id(): Snappy,
+		Zstd.Id():   Zstd,
+	},
+}
+
+// SetCompression设置压缩算法, 长度不小于threshold的数据被压缩; c为nil时不压缩
+// 关闭压缩之后, 已压缩的数据仍然可以读取
+func SetCompression(c Compressor, threshold int) error {
+	if c != nil {
+		if err := RegisterCompressor(c); err != nil {
+			return err
+		}
+	}
+	compression.Lock()
+	compression.c = c
+	compression.threshold = threshold
+	compression.Unlock()
+	return nil
+}
+
+// RegisterCompressor注册自定义的Compressor, 读取时才能识别该Compressor压缩的数据
+// 使用SetCompression时自动注册
+func RegisterCompressor(c Compressor) error {
+	id := c.Id()
+	if id < minCompressorId || id > maxCompressorId {
+		return fmt.Errorf("compressor id must be between %d and %d.", minCompressorId, maxCompressorId)
+	}
+
+	compression.Lock()
+	defer compression.Unlock()
+	if old, ok := compression.byId[id]; ok && old != c {
+		return fmt.Errorf("compressor id %d has been registered.", id)
+	}
+	compression.byId[id] = c
+	return nil
+}
+
+// 长度达到阈值时压缩并加上标记
+func compress(buf []byte) ([]byte, error) {
+	compression.RLock()
+	c, threshold := compression.c, compression.threshold
+	compression.RUnlock()
+	if c == nil || len(buf) < threshold {
+		return buf, nil
+	}
+
+	data, err := c.Compress(buf)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{c.Id()}, data...), nil
+}
+
+// 数据有压缩标记时解压, 否则原样返回
+func decompress(buf []byte) ([]byte, error) {
+	if len(buf) == 0 || buf[0] < minCompressorId || buf[0] > maxCompressorId {
+		return buf, nil
+	}
+	compression.RLock()
+	c, ok := compression.byId[buf[0]]
+	compression.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown compressor %d.", buf[0])
+	}
+	return c.Decompress(buf[1:])
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Id() byte { return 16 }
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Id() byte { return 17 }
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCompressor) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+// zstd的encoder及decoder可以并发使用, 第一次使用时创建
+type zstdCompressor struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error
+}
+
+func (z *zstdCompressor) Id() byte { return 18 }
+
+func (z *zstdCompressor) init() error {
+	z.once.Do(func() {
+		if z.enc, z.err = zstd.NewWriter(nil); z.err != nil {
+			return
+		}
+		z.dec, z.err = zstd.NewReader(nil)
+	})
+	return z.err
+}
+
+func (z *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.enc.EncodeAll(data, nil), nil
+}
+
+func (z *zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.dec.DecodeAll(data, nil)
+}
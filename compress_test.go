@@ -0,0 +1,52 @@
+package orr
+
+import (
+	"strings"
+	"testing"
+)
+
+type Tcompress struct {
+	Id   int64
+	Body string
+}
+
+func TestCompression(t *testing.T) {
+	defer SetCompression(nil, 0)
+
+	conn := rpool.Get()
+	defer conn.Close()
+	body := strings.Repeat("orr compression ", 1000)
+	for _, c := range []Compressor{Gzip, Snappy, Zstd} {
+		if err := SetCompression(c, 1024); err != nil {
+			t.Fatal(err.Error())
+		}
+		big := &Tcompress{Body: body}
+		small := &Tcompress{Body: "small"}
+		if _, err := Insert(big, false); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := Insert(small, false); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		buf, _ := conn.Do("HGET", "tcompress", big.Id)
+		if b := buf.([]byte); b[0] != c.Id() || len(b) >= len(body) {
+			t.Fatalf("compressor %d: large value should be compressed", c.Id())
+		}
+		buf, _ = conn.Do("HGET", "tcompress", small.Id)
+		if b := buf.([]byte); b[0] != '{' {
+			t.Fatalf("compressor %d: small value should not be compressed", c.Id())
+		}
+
+		// 关闭压缩之后仍然可以读取
+		SetCompression(nil, 0)
+		var res []Tcompress
+		if errs, err := SelectMany([]int64{big.Id, small.Id}, "tcompress", &res); err != nil ||
+			errs[0] != nil || errs[1] != nil {
+			t.Fatalf("compressor %d: SelectMany failed", c.Id())
+		}
+		if res[0].Body != body || res[1].Body != "small" {
+			t.Fatalf("compressor %d: round trip failed", c.Id())
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package orr
+
+// 分组计数
+//
+// tag为count的字段, 每个字段值的对象数量保存在hashmap(结构名_字段名:count)中,
+// field为字段值, value为数量. 计数与对象的写入在同一个事务中通过HINCRBY更新.
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+)
+
+func countKey(name string, fieldName string) string {
+	return redisKey(name, fieldSuffix(fieldName)+":count")
+}
+
+// CountsBy返回类型name按字段field分组的对象数量, 不包含数量为0的分组
+func CountsBy(name, field string) (map[string]int64, error) {
+	conns := allConns()
+	defer closeConns(conns)
+	counts := make(map[string]int64)
+	for _, conn := range conns {
+		values, err := redis.Strings(conn.Do("HGETALL", countKey(name, field)))
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i+1 < len(values); i += 2 {
+			n, err := strconv.ParseInt(values[i+1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			counts[values[i]] += n
+		}
+	}
+	for value, n := range counts {
+		if n == 0 {
+			delete(counts, value)
+		}
+	}
+	return counts, nil
+}
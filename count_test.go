@@ -0,0 +1,47 @@
+package orr
+
+import (
+	"testing"
+)
+
+type Tcount struct {
+	Id     int64
+	IpAddr string `orr:"count"`
+	Status bool   `orr:"count"`
+}
+
+func TestCountsBy(t *testing.T) {
+	objs := []interface{}{
+		&Tcount{IpAddr: "10.0.0.1", Status: true},
+		&Tcount{IpAddr: "10.0.0.1"},
+		&Tcount{IpAddr: "10.0.0.2"},
+	}
+	if _, errs := InsertMany(objs, false); errs[0] != nil {
+		t.Fatal(errs[0].Error())
+	}
+	defer DeleteMany(objs)
+
+	counts, err := CountsBy("tcount", "IpAddr")
+	if err != nil || counts["10.0.0.1"] != 2 || counts["10.0.0.2"] != 1 {
+		t.Fatal("CountsBy IpAddr wrong", counts)
+	}
+
+	u := objs[2].(*Tcount)
+	u.IpAddr, u.Status = "10.0.0.1", true
+	if err = Update(u, "tcount", u.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	if counts, _ = CountsBy("tcount", "ipaddr"); len(counts) != 1 || counts["10.0.0.1"] != 3 {
+		t.Fatal("CountsBy not updated", counts)
+	}
+	if counts, _ = CountsBy("tcount", "status"); counts["true"] != 2 || counts["false"] != 1 {
+		t.Fatal("CountsBy Status wrong", counts)
+	}
+
+	// 重复删除不影响计数
+	Delete(u)
+	Delete(u)
+	if counts, _ = CountsBy("tcount", "ipaddr"); counts["10.0.0.1"] != 2 {
+		t.Fatal("CountsBy wrong after Delete", counts)
+	}
+}
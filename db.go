@@ -1,8 +1,9 @@
 package orr
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"github.com/garyburd/redigo/redis"
 	"reflect"
 	"strconv"
 	"strings"
@@ -13,8 +14,12 @@ import (
 // tags:
 //   orr
 //     index: 该字段名与结构名(结构名_字段名)，作为辅助hashmap，hashmap的field为该字段值，hashmap的值位obj.Id
+//     set, range: 集合索引及范围索引, 用于Query, 见model.go
 //     list: 该字段名与结构名(结构名_字段名)，作为辅助list
 //  example: `orr:"index"`
+//   valid
+//     字段的约束, Insert及Update之前校验, 见validate.go
+//  example: `valid:"not null;maxlen:20"`
 
 // map,list数据过大的解决方法：
 //  当map,list数据较少时(1000个以内)，可以将map,list数据保存为json格式; 当map,list数据超过一定规模时，
@@ -25,6 +30,11 @@ import (
 // 来设置redis的辅助字段
 // 返回Id
 func Insert(obj interface{}, index bool) (int64, error) {
+	return InsertContext(context.Background(), obj, index)
+}
+
+// InsertContext与Insert相同, ctx用于传递操作者, 租户等信息, 见history.go, tenant.go
+func InsertContext(ctx context.Context, obj interface{}, index bool) (int64, error) {
 	if reflect.TypeOf(obj).Kind() != reflect.Ptr {
 		return -1, fmt.Errorf("param obj MUST be type Ptr.")
 	}
@@ -35,119 +45,272 @@ func Insert(obj interface{}, index bool) (int64, error) {
 		return -1, fmt.Errorf("Param obj must be struct type.")
 	}
 
-	objName := getTypeName(rtobj)
+	m, err := getModel(rtobj).scope(ctx)
+	if err != nil {
+		return -1, err
+	}
+	if err := m.prepareInsert(rvobj); err != nil {
+		return -1, err
+	}
+	if err := beforeInsert(obj); err != nil {
+		return -1, err
+	}
+	if err := m.validate(rvobj); err != nil {
+		return -1, err
+	}
 
 	// 查看结构体是否有辅助字段
-	var (
-		idxkeys   []string = make([]string, 0)
-		idxfields []string = make([]string, 0)
-		vid       reflect.Value
-	)
-	for i := 0; i < rtobj.NumField(); i++ {
-		structfield := rtobj.Field(i)
-		if structfield.Anonymous {
-			continue
-		}
-
-		fieldName := structfield.Name
-		tag := structfield.Tag
-		if tag == "" || tag == "-" {
-			continue
-		}
-
-		if tag.Get("orr") == "index" {
-			fieldValue := rvobj.Field(i)
-			if fieldValue.Kind() != reflect.String {
-				return -1, fmt.Errorf("index field must be string type!")
-			}
-			fv := fieldValue.Interface().(string)
-			if fv == "" {
-				if index {
-					return -1, fmt.Errorf("field %s should be index, but is empty.", fieldName)
-				} else {
-					continue
-				}
-			}
-
-			if unique(objName+"_"+fieldName, fv) != true {
-				return -1, fmt.Errorf("field %s has exist value %s.", fieldName, fieldValue)
-			}
-			idxkeys = append(idxkeys, objName+"_"+strings.Replace(strings.ToLower(fieldName), "_", "", -1))
-			idxfields = append(idxfields, fv)
+	idxkeys, idxfields, err := indexFields(rvobj, rtobj, m.name, index)
+	if err != nil {
+		return -1, err
+	}
+	for i := 0; i < len(idxkeys); i++ {
+		if unique(idxkeys[i], idxfields[i]) != true {
+			return -1, fmt.Errorf("field %s has exist value %s.", idxkeys[i], idxfields[i])
 		}
 	}
 
-	id := NewId(objName)
+	id := NewId(m.name)
 	sid := strconv.FormatInt(id, 10)
 
-	bsid := []byte(sid)
-	for i := 0; i < len(idxkeys); i++ {
-		hsetToRedis(idxkeys[i], idxfields[i], bsid, "map")
+	vid := rvobj.FieldByName("Id")
+	vid.SetInt(id)
+	buf, err := m.encode(obj)
+	if err != nil {
+		ReturnId(m.name, id)
+		return -1, err
 	}
 
-	vid = rvobj.FieldByName("Id")
-	vid.SetInt(id)
-	buf, err := json.Marshal(obj)
+	// 主hashmap, 创建时间zset及辅助索引在同一个事务中写入
+	t := &tx{}
+	t.add("HSET", hashKey(m.name), sid, buf)
+	t.add("ZADD", createdKey(m.name), createdScore(), sid)
+	if m.ttl > 0 {
+		t.add("ZADD", expireKey(m.name), expireScore(m.ttl), sid)
+	}
+	if err = m.addIndexes(t, sid, rvobj); err == nil {
+		err = m.historyCommands(ctx, t, "insert", sid, reflect.Value{})
+	}
 	if err != nil {
-		ReturnId(objName, id)
+		ReturnId(m.name, id)
 		return -1, err
 	}
+	changeCommand(t, m.name, sid, "insert", m.changedFields(reflect.Value{}, rvobj), buf)
 
-	err = hsetToRedis(objName, sid, buf, "map")
+	conn, err := objConn(m.name, id)
+	if err != nil {
+		ReturnId(m.name, id)
+		return -1, err
+	}
+	defer conn.Close()
+	_, err = t.exec(conn)
+	if redirected(err) {
+		// 集群正在迁移slot, 更新slot表后重试一次
+		_, err = t.exec(conn)
+	}
 	if err != nil {
-		for i := 0; i < len(idxkeys); i++ {
-			hdelFromRedis(idxkeys[i], idxfields[i], "map")
+		ReturnId(m.name, id)
+		return -1, err
+	}
+
+	return id, afterInsert(obj)
+}
+
+// 查找结构体中tag为index的字段, 返回辅助hashmap的key及对应的字段值
+// index为true时, index字段不能为空
+func indexFields(rvobj reflect.Value, rtobj reflect.Type, objName string,
+	index bool) (idxkeys []string, idxfields []string, err error) {
+	for _, f := range getModel(rtobj).fields {
+		if !f.has("index") {
+			continue
 		}
 
-		ReturnId(objName, id)
-		return -1, err
+		fieldValue := rvobj.Field(f.index)
+		if fieldValue.Kind() != reflect.String {
+			return nil, nil, fmt.Errorf("index field must be string type!")
+		}
+		fv := fieldValue.String()
+		if fv == "" {
+			if index {
+				return nil, nil, fmt.Errorf("field %s should be index, but is empty.", f.name)
+			}
+			continue
+		}
+		if fv, err = getModel(rtobj).indexValue(f, fv); err != nil {
+			return nil, nil, err
+		}
+
+		idxkeys = append(idxkeys, indexKey(objName, f.name))
+		idxfields = append(idxfields, fv)
+		// 回收站中的对象保留的值也不能使用
+		if getModel(rtobj).softReserve {
+			idxkeys = append(idxkeys, reservedKey(objName, f.name))
+			idxfields = append(idxfields, fv)
+		}
 	}
 
-	return id, nil
+	return idxkeys, idxfields, nil
+}
+
+// 辅助hashmap的key: 结构名_字段名
+func indexKey(objName, fieldName string) string {
+	return redisKey(objName, fieldSuffix(fieldName))
 }
 
 // 将结构体的field插入到数据库中
 // typ should be "key" or "hash"
 func InsertKeyField(typ, name string, fn string, id int64, value interface{}) error {
-	buf, err := json.Marshal(&value)
+	buf, err := encodeValue(codecOf(name), value)
+	if err != nil {
+		return err
+	}
+	conn, err := objConn(name, id)
 	if err != nil {
 		return err
 	}
-	conn := rpool.Get()
 	defer conn.Close()
 	sid := strconv.FormatInt(id, 10)
 	switch typ {
 	case "key":
-		_, err := conn.Do("SET", name+"_"+fn+"_"+sid, buf)
-		return err
+		_, err = conn.Do("SET", keyFieldKey(name, fn, sid), buf)
 
 	case "hash":
-		_, err := conn.Do("HSET", name+"_"+fn, sid, buf)
-		return err
+		_, err = conn.Do("HSET", keyFieldHashKey(name, fn), sid, buf)
 
 	default:
 		return fmt.Errorf("param typ invalid, must be key or hash or list.")
 	}
+	if err != nil {
+		return err
+	}
 
-	return nil
+	// 记录类型的KeyField, 对象过期时一并删除
+	_, err = conn.Do("SADD", keyFieldsKey(name), typ+":"+fn)
+	return err
 }
 
 func BuildRelation() {
 
 }
 
-// 仅更新主hashmap
+// 更新主hashmap, 并根据redis中保存的旧数据更新辅助索引
+// 读取旧数据与写入在WATCH的保护下进行, 并发修改时重试
+// 对象不存在时返回ErrNotFound
 func Update(obj interface{}, objName string, objId int64) error {
-	buf, err := json.Marshal(obj)
+	return UpdateContext(context.Background(), obj, objName, objId)
+}
+
+// UpdateContext与Update相同, ctx用于传递操作者, 租户等信息, 见history.go, tenant.go
+func UpdateContext(ctx context.Context, obj interface{}, objName string, objId int64) error {
+	obj = addressable(obj)
+	rvobj := reflect.Indirect(reflect.ValueOf(obj))
+	if rvobj.Kind() != reflect.Struct {
+		return fmt.Errorf("Param obj must be struct type.")
+	}
+	if err := beforeUpdate(obj); err != nil {
+		return err
+	}
+	// 租户可以由ctx或者objName指定
+	tenant, base := splitScopedName(objName)
+	if t := TenantFrom(ctx); t != "" {
+		tenant = t
+	}
+	if tenant != "" {
+		if err := checkTenant(tenant); err != nil {
+			return err
+		}
+	}
+	m := getModel(rvobj.Type()).scoped(tenant)
+	objName = scopedName(tenant, base)
+	if err := m.checkName(); err != nil {
+		return err
+	}
+	if err := m.validate(rvobj); err != nil {
+		return err
+	}
+	sid := strconv.FormatInt(objId, 10)
+
+	conn, err := objConn(objName, objId)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
+	for retry := 0; ; retry++ {
+		if _, err := conn.Do("WATCH", hashKey(objName)); err != nil {
+			return err
+		}
+		// 只能更新已存在的对象, 否则会绕过Insert的唯一性检查
+		old, ok, err := m.load(conn, hashKey(objName), sid)
+		if err == nil && !ok {
+			err = ErrNotFound
+			// 回收站中的对象不能被Update恢复, 否则Purge会删除其唯一索引
+			if m.soft != nil {
+				if deleted, _ := redis.Bool(conn.Do("HEXISTS", trashKey(objName), sid)); deleted {
+					err = ErrDeleted
+				}
+			}
+		}
+		if err == nil {
+			err = m.prepareUpdate(rvobj, old)
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		buf, err := m.encode(obj)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
 
-	err = hsetToRedis(objName, strconv.FormatInt(objId, 10), buf, "map")
-	return err
+		// 唯一索引的值发生变化时, 新值不能被其他对象占用
+		for _, f := range m.fields {
+			if !f.has("index") {
+				continue
+			}
+			nv := rvobj.Field(f.index).String()
+			if nv == "" || nv == old.Field(f.index).String() {
+				continue
+			}
+			iv, err := m.indexValue(f, nv)
+			if err != nil {
+				conn.Do("UNWATCH")
+				return err
+			}
+			if unique(indexKey(m.name, f.name), iv) != true ||
+				(m.softReserve && unique(reservedKey(m.name, f.name), iv) != true) {
+				conn.Do("UNWATCH")
+				return fmt.Errorf("field %s has exist value %s.", f.name, nv)
+			}
+		}
+
+		t := &tx{}
+		err = m.updateIndexes(t, sid, old, rvobj)
+		if err == nil {
+			err = m.historyCommands(ctx, t, "update", sid, old)
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		t.add("HSET", hashKey(objName), sid, buf)
+		changeCommand(t, objName, sid, "update", m.changedFields(old, rvobj), buf)
+
+		_, err = t.exec(conn)
+		if (err != errWatch && !redirected(err)) || retry >= maxWatchRetry {
+			return err
+		}
+	}
 }
 
+// 删除对象, 根据redis中保存的数据删除辅助索引; 对象不存在时直接返回
+// 类型有softdelete字段时为软删除, 见softdelete.go
 func Delete(obj interface{}) error {
+	return DeleteContext(context.Background(), obj)
+}
+
+// DeleteContext与Delete相同, ctx用于传递操作者, 租户等信息, 见history.go, tenant.go
+func DeleteContext(ctx context.Context, obj interface{}) error {
 	var (
 		rvobj reflect.Value
 		rtobj reflect.Type
@@ -165,64 +328,101 @@ func Delete(obj interface{}) error {
 		return fmt.Errorf("Param obj must be struct type.")
 	}
 
-	var (
-		idxfields []string
-		idxvalue  []string
-	)
-	objName := getTypeName(rtobj)
+	m, err := getModel(rtobj).scope(ctx)
+	if err != nil {
+		return err
+	}
+	id := rvobj.FieldByName("Id").Int()
+	sid := strconv.FormatInt(id, 10)
 
-	for i := 0; i < rtobj.NumField(); i++ {
-		structfield := rtobj.Field(i)
-		if structfield.Anonymous {
-			continue
+	conn, err := objConn(m.name, id)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for retry := 0; ; retry++ {
+		if _, err := conn.Do("WATCH", hashKey(m.name)); err != nil {
+			return err
 		}
-
-		fieldName := structfield.Name
-		tag := structfield.Tag
-		if tag == "" || tag == "-" {
-			continue
+		old, ok, err := m.load(conn, hashKey(m.name), sid)
+		if err != nil || !ok {
+			conn.Do("UNWATCH")
+			return err
 		}
 
-		if tag.Get("orr") == "index" {
-			if rvobj.Field(i).String() != "" {
-				idxfields = append(idxfields, objName+"_"+strings.ToLower(fieldName))
-				idxvalue = append(idxvalue, rvobj.Field(i).String())
-			}
+		t := &tx{}
+		if err = m.deleteCommands(ctx, t, sid, old); err != nil {
+			conn.Do("UNWATCH")
+			return err
 		}
-	}
-	conn := rpool.Get()
-	defer conn.Close()
-	id := rvobj.FieldByName("Id").Int()
-	sid := strconv.FormatInt(id, 10)
-	for i, field := range idxfields {
-		conn.Send("HDEL", field, idxvalue[i])
-	}
-	conn.Send("HDEL", objName, sid)
-	conn.Flush()
-	/*
-		for i := 0; i <= len(idxfields); i++ {
-			fmt.Println("conn receive ", i)
-			r, err := conn.Receive()
-			if err != nil {
-				fmt.Println(err.Error())
-			} else {
-				fmt.Println(r)
-			}
+		_, err = t.exec(conn)
+		if err == nil {
+			return afterDelete(addressable(obj))
+		}
+		if (err != errWatch && !redirected(err)) || retry >= maxWatchRetry {
+			return err
 		}
-	*/
+	}
+}
+
+// 读取redis中hashmap key保存的对象; ok为false时表示对象不存在
+func (m *model) load(conn redis.Conn, key string, sid string) (reflect.Value, bool, error) {
+	reply, err := conn.Do("HGET", key, sid)
+	if err != nil || reply == nil {
+		return reflect.Value{}, false, err
+	}
+	return m.decode(reply.([]byte))
+}
+
+func (m *model) decode(buf []byte) (reflect.Value, bool, error) {
+	rv := reflect.New(m.typ)
+	if err := decodeValue(buf, rv.Interface()); err != nil {
+		return reflect.Value{}, false, err
+	}
+	if err := m.open(rv.Elem()); err != nil {
+		return reflect.Value{}, false, err
+	}
+	return rv.Elem(), true, nil
+}
+
+// 删除对象的命令, old为redis中保存的对象; 类型支持软删除时将对象移入回收站
+func (m *model) deleteCommands(ctx context.Context, t *tx, sid string, old reflect.Value) error {
+	if err := m.historyCommands(ctx, t, "delete", sid, old); err != nil {
+		return err
+	}
+	buf, err := m.encode(old.Addr().Interface())
+	if err != nil {
+		return err
+	}
+	changeCommand(t, m.name, sid, "delete", nil, buf)
+	if m.soft != nil {
+		return m.softDeleteCommands(t, sid, old)
+	}
+	m.purgeCommands(t, sid, old)
 	return nil
 }
 
+// 删除对象的主hashmap, 创建时间zset及辅助索引
+func (m *model) purgeCommands(t *tx, sid string, old reflect.Value) {
+	m.removeIndexes(t, sid, old)
+	t.add("HDEL", hashKey(m.name), sid)
+	t.add("ZREM", createdKey(m.name), sid)
+	t.add("ZREM", expireKey(m.name), sid)
+}
+
 func DeleteKeyField(typ string, name string, fn string, id int64) {
-	conn := rpool.Get()
+	conn, err := objConn(name, id)
+	if err != nil {
+		return
+	}
 	defer conn.Close()
 	switch typ {
 	case "key":
-		conn.Do("DEL", name+"_"+fn+"_"+strconv.FormatInt(id, 10))
+		conn.Do("DEL", keyFieldKey(name, fn, strconv.FormatInt(id, 10)))
 		return
 
 	case "hash":
-		conn.Do("HDEL", name+"_"+fn, strconv.FormatInt(id, 10))
+		conn.Do("HDEL", keyFieldHashKey(name, fn), strconv.FormatInt(id, 10))
 		return
 
 	default:
@@ -235,29 +435,65 @@ func Select(Id int64, name string, res interface{}) error {
 	if reflect.TypeOf(res).Kind() != reflect.Ptr {
 		return fmt.Errorf("param res must be Ptr type.")
 	}
-	conn := rpool.Get()
+	conn, err := objReadConn(name, Id)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
-	reply, err := conn.Do("HGET", name, strconv.FormatInt(Id, 10))
+	sid := strconv.FormatInt(Id, 10)
+	conn.Send("HGET", hashKey(name), sid)
+	conn.Send("ZSCORE", expireKey(name), sid)
+	replies, err := redis.Values(conn.Do(""))
 	if err != nil {
 		return err
 	}
+	// 已过期但尚未被清理的对象视为不存在
+	if replies[0] == nil || expired(replies[1]) {
+		return ErrNotFound
+	}
 
-	err = json.Unmarshal(reply.([]byte), res)
-	return err
+	return decodeObject(replies[0].([]byte), res)
 }
 
 func SelectIndex(name, fn, value string) (int64, error) {
-	conn := rpool.Get()
-	defer conn.Close()
-	reply, err := conn.Do("HGET", name+"_"+fn, value)
-	if err != nil || reply == nil {
-		return -1, err
+	// 加密字段的辅助hashmap中保存的是盲索引
+	// 未使用过的类型无法判断字段是否加密, 设置了KeyProvider时必须先Register
+	if m, ok := modelByName(name); ok {
+		if f, err := m.field(fn); err == nil {
+			v, err := m.indexValue(f, value)
+			if err != nil {
+				return -1, err
+			}
+			value = v
+		}
+	} else if _, err := getKeyProvider(); err == nil {
+		return -1, fmt.Errorf("type %s is not registered, Register it before SelectIndex when encryption is enabled.", name)
 	}
-	id, err := strconv.ParseInt(string(reply.([]byte)), 10, 64)
-	if err != nil {
-		return -1, err
+
+	// 使用客户端分片时, 索引保存在对象所在的分片中
+	var conns []redis.Conn
+	if sharded() {
+		conns = allConns()
+	} else {
+		conns = []redis.Conn{readConn()}
 	}
-	return id, nil
+	defer closeConns(conns)
+	for _, conn := range conns {
+		reply, err := conn.Do("HGET", indexKey(name, fn), value)
+		if err != nil {
+			return -1, err
+		}
+		if reply == nil {
+			continue
+		}
+		// 已过期但尚未清理的对象视为不存在
+		flags, err := expiredFlags(conn, name, []interface{}{reply})
+		if err != nil || flags[0] {
+			return -1, err
+		}
+		return strconv.ParseInt(string(reply.([]byte)), 10, 64)
+	}
+	return -1, nil
 }
 
 func SelectKeyField(keyTyp string, name string,
@@ -268,13 +504,16 @@ func SelectKeyField(keyTyp string, name string,
 	var reply interface{}
 
 	sid := strconv.FormatInt(id, 10)
-	conn := rpool.Get()
+	conn, err := objReadConn(name, id)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 	switch keyTyp {
 	case "key":
-		reply, err = conn.Do("GET", name+"_"+fn+"_"+sid)
+		reply, err = conn.Do("GET", keyFieldKey(name, fn, sid))
 	case "hash":
-		reply, err = conn.Do("HGET", name+"_"+fn, sid)
+		reply, err = conn.Do("HGET", keyFieldHashKey(name, fn), sid)
 	default:
 		return fmt.Errorf("Not support this keytype: %s", keyTyp)
 	}
@@ -286,48 +525,40 @@ func SelectKeyField(keyTyp string, name string,
 		return
 	}
 
-	err = json.Unmarshal(reply.([]byte), res)
+	err = decodeValue(reply.([]byte), res)
 	return err
 }
 
-func getLatestId(name string) (string, error) {
-	conn := rpool.Get()
-	defer conn.Close()
-	reply, err := conn.Do("INCR", name)
-	if err != nil {
-		return "", err
+// 解析valid tag, 选项以;分隔, 选项的值以:分隔, 选项名转换为大写
+// 如 `valid:"not null;maxlen:20"` 返回 {"NOT NULL": "", "MAXLEN": "20"}
+func parseTag(str string) map[string]string {
+	m := make(map[string]string)
+	if str == "" || str == "-" {
+		return m
 	}
-
-	return reply.(string), nil
-}
-
-func parseTag(str string) (typ string, addational_typ string) {
-	if str == "-" {
-		typ = str
-	} else if str != "" {
-		tags := strings.Split(str, ";")
-		m := make(map[string]string)
-		for _, value := range tags {
-			v := strings.Split(value, ":")
-			k := strings.TrimSpace(strings.ToUpper(v[0]))
-			if len(v) == 2 {
-				m[k] = v[1]
-			} else {
-				m[k] = k
-			}
+	for _, value := range strings.Split(str, ";") {
+		v := strings.SplitN(value, ":", 2)
+		k := strings.TrimSpace(strings.ToUpper(v[0]))
+		if k == "" {
+			continue
+		}
+		if len(v) == 2 {
+			m[k] = strings.TrimSpace(v[1])
+		} else {
+			m[k] = ""
 		}
-
-		addational_typ = m["NOT NULL"] + " " + m["UNIQUE"]
 	}
-	return
+	return m
 }
 
 func unique(name string, value string) bool {
-	conn := rpool.Get()
-	defer conn.Close()
-	reply, _ := conn.Do("HGET", name, value)
-	if reply != nil {
-		return false
+	conns := allConns()
+	defer closeConns(conns)
+	for _, conn := range conns {
+		reply, _ := conn.Do("HGET", name, value)
+		if reply != nil {
+			return false
+		}
 	}
 
 	return true
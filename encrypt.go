@@ -0,0 +1,240 @@
+package orr
+
+// 字段加密
+//
+// tag为encrypt的string字段在保存到redis之前使用AES-GCM加密, 读取时解密:
+//   Password string `orr:"encrypt"`
+// 加密后的值为 orr:enc:keyid:base64(nonce+密文), 没有该前缀的值视为明文, 因此之前写入的数据仍然可以读取.
+// Save保存加密字段时同样写入密文, Restore读取时解密.
+// key由KeyProvider提供, 新数据使用CurrentKey加密, 解密时按keyid查找key, 因此可以轮换key.
+//
+// 加密字段同时为index时, 辅助hashmap中保存的是字段值的盲索引(HMAC-SHA256),
+// SelectIndex及Query的=条件自动计算查询值的盲索引. 盲索引使用IndexKey, IndexKey不能轮换.
+// SelectIndex只有类型名, 设置了KeyProvider时, 类型必须已经Register(或在本进程中使用过), 否则返回错误.
+// 加密字段不能使用其他索引(set, range, text, prefix等), 否则会泄露明文.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const encryptPrefix = "orr:enc:"
+
+type KeyProvider interface {
+	// 当前用于加密的key及其id, id不能包含:
+	CurrentKey() (id string, key []byte, err error)
+	// 按id返回key, 用于解密
+	Key(id string) ([]byte, error)
+	// 计算盲索引使用的HMAC key
+	IndexKey() ([]byte, error)
+}
+
+// StaticKeys为固定的KeyProvider, Keys的key为keyid, value为16, 24或32字节的AES key
+type StaticKeys struct {
+	Current string
+	Keys    map[string][]byte
+	Index   []byte
+}
+
+func (s *StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := s.Key(s.Current)
+	return s.Current, key, err
+}
+
+func (s *StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := s.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %s not found.", id)
+	}
+	return key, nil
+}
+
+func (s *StaticKeys) IndexKey() ([]byte, error) {
+	if len(s.Index) == 0 {
+		return nil, fmt.Errorf("index key is empty.")
+	}
+	return s.Index, nil
+}
+
+var keyProvider struct {
+	sync.RWMutex
+	p KeyProvider
+}
+
+// SetKeyProvider设置加密使用的KeyProvider, 应在程序启动时调用
+func SetKeyProvider(p KeyProvider) {
+	keyProvider.Lock()
+	keyProvider.p = p
+	keyProvider.Unlock()
+}
+
+func getKeyProvider() (KeyProvider, error) {
+	keyProvider.RLock()
+	defer keyProvider.RUnlock()
+	if keyProvider.p == nil {
+		return nil, fmt.Errorf("key provider is not set.")
+	}
+	return keyProvider.p, nil
+}
+
+// 附加数据, 使密文只能用于同一个类型的同一个字段
+func (m *model) aad(f *field) []byte {
+	return []byte(m.baseName() + "." + f.name)
+}
+
+func (m *model) encrypt(f *field, plain string) (string, error) {
+	p, err := getKeyProvider()
+	if err != nil {
+		return "", err
+	}
+	id, key, err := p.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(id, ":") {
+		return "", fmt.Errorf("encryption key id %s should not contains :.", id)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), m.aad(f))
+	return encryptPrefix + id + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func (m *model) decrypt(f *field, s string) (string, error) {
+	if !strings.HasPrefix(s, encryptPrefix) {
+		return s, nil
+	}
+	parts := strings.SplitN(s[len(encryptPrefix):], ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("field %s: invalid encrypted value.", f.name)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	p, err := getKeyProvider()
+	if err != nil {
+		return "", err
+	}
+	key, err := p.Key(parts[0])
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("field %s: invalid encrypted value.", f.name)
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], m.aad(f))
+	if err != nil {
+		return "", fmt.Errorf("field %s: decrypt failed: %s", f.name, err.Error())
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 返回rv的拷贝, 其中加密字段的值为密文
+func (m *model) seal(rv reflect.Value) (reflect.Value, error) {
+	if !m.encrypted {
+		return rv, nil
+	}
+	cp := reflect.New(m.typ).Elem()
+	cp.Set(rv)
+	for _, f := range m.fields {
+		if !f.has("encrypt") {
+			continue
+		}
+		if err := m.checkEncrypt(f); err != nil {
+			return reflect.Value{}, err
+		}
+		fv := cp.Field(f.index)
+		if fv.String() == "" {
+			continue
+		}
+		s, err := m.encrypt(f, fv.String())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		fv.SetString(s)
+	}
+	return cp, nil
+}
+
+// 解密rv中加密字段的值
+func (m *model) open(rv reflect.Value) error {
+	for _, f := range m.fields {
+		if !f.has("encrypt") || f.typ.Kind() != reflect.String {
+			continue
+		}
+		fv := rv.Field(f.index)
+		s, err := m.decrypt(f, fv.String())
+		if err != nil {
+			return err
+		}
+		fv.SetString(s)
+	}
+	return nil
+}
+
+func (m *model) checkEncrypt(f *field) error {
+	if f.typ.Kind() != reflect.String {
+		return fmt.Errorf("encrypt field %s must be string type.", f.name)
+	}
+	for _, opt := range []string{"set", "range", "text", "prefix", "tags", "count"} {
+		if f.has(opt) {
+			return fmt.Errorf("encrypt field %s cannot have %s index.", f.name, opt)
+		}
+	}
+	return nil
+}
+
+// 盲索引: 字段值的HMAC-SHA256
+func (m *model) blindIndex(f *field, value string) (string, error) {
+	p, err := getKeyProvider()
+	if err != nil {
+		return "", err
+	}
+	key, err := p.IndexKey()
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(m.aad(f))
+	h.Write([]byte{0})
+	h.Write([]byte(value))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// 唯一索引的辅助hashmap中保存的字段值, 加密字段为盲索引
+func (m *model) indexValue(f *field, value string) (string, error) {
+	if value == "" || !f.has("encrypt") {
+		return value, nil
+	}
+	return m.blindIndex(f, value)
+}
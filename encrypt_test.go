@@ -0,0 +1,108 @@
+package orr
+
+import (
+	"bytes"
+	"testing"
+)
+
+type Tencrypt struct {
+	Id       int64
+	Name     string
+	Mobileno string `orr:"index;encrypt"`
+	Password string `orr:"encrypt"`
+}
+
+func TestEncrypt(t *testing.T) {
+	keys := &StaticKeys{
+		Current: "k1",
+		Keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+		Index:   []byte("index key"),
+	}
+	SetKeyProvider(keys)
+	defer SetKeyProvider(nil)
+
+	e := &Tencrypt{Name: "enc", Mobileno: "13800000000", Password: "secret"}
+	if _, err := Insert(e, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	conn := rpool.Get()
+	defer conn.Close()
+	buf, _ := conn.Do("HGET", "tencrypt", e.Id)
+	if bytes.Contains(buf.([]byte), []byte("secret")) || bytes.Contains(buf.([]byte), []byte("13800000000")) {
+		t.Fatal("encrypted fields should not be stored in plaintext")
+	}
+	if e.Password != "secret" {
+		t.Fatal("Insert should not modify the object")
+	}
+
+	if _, err := SelectIndex("tencryptunknown", "mobileno", "13800000000"); err == nil {
+		t.Fatal("SelectIndex on unregistered type should fail when encryption is enabled")
+	}
+
+	var e2 Tencrypt
+	if err := Select(e.Id, "tencrypt", &e2); err != nil {
+		t.Fatal(err.Error())
+	}
+	if e2.Password != "secret" || e2.Mobileno != "13800000000" {
+		t.Fatalf("decrypt failed: %+v", e2)
+	}
+	if id, err := SelectIndex("tencrypt", "mobileno", "13800000000"); err != nil || id != e.Id {
+		t.Fatal("SelectIndex should work with encrypted index field")
+	}
+	if _, err := Insert(&Tencrypt{Mobileno: "13800000000"}, false); err == nil {
+		t.Fatal("encrypted index field should still be unique")
+	}
+
+	// 轮换key之后, 旧key加密的数据仍然可以读取
+	keys.Keys["k2"] = bytes.Repeat([]byte{2}, 32)
+	keys.Current = "k2"
+	var e3 Tencrypt
+	if err := Select(e.Id, "tencrypt", &e3); err != nil || e3.Password != "secret" {
+		t.Fatal("data encrypted with old key should be readable")
+	}
+	e3.Mobileno = "13900000000"
+	if err := Update(&e3, "tencrypt", e3.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	if id, _ := SelectIndex("tencrypt", "mobileno", "13800000000"); id != -1 {
+		t.Fatal("old blind index should be removed")
+	}
+	if id, _ := SelectIndex("tencrypt", "mobileno", "13900000000"); id != e.Id {
+		t.Fatal("new blind index should be added")
+	}
+	if err := Delete(&e3); err != nil {
+		t.Fatal(err.Error())
+	}
+	if id, _ := SelectIndex("tencrypt", "mobileno", "13900000000"); id != -1 {
+		t.Fatal("blind index should be removed with object")
+	}
+}
+
+func TestEncryptSave(t *testing.T) {
+	SetKeyProvider(&StaticKeys{
+		Current: "k1",
+		Keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+		Index:   []byte("index key"),
+	})
+	defer SetKeyProvider(nil)
+
+	e := &Tencrypt{Id: 100, Password: "saved secret"}
+	if err := Save(e, "Password"); err != nil {
+		t.Fatal(err.Error())
+	}
+	conn := rpool.Get()
+	defer conn.Close()
+	defer conn.Do("DEL", redisKey("tencrypt", "_password"))
+	buf, _ := conn.Do("HGET", redisKey("tencrypt", "_password"), e.Id)
+	if buf == nil || bytes.Contains(buf.([]byte), []byte("saved secret")) {
+		t.Fatal("saved encrypted field should not be stored in plaintext")
+	}
+
+	e2 := &Tencrypt{Id: 100}
+	if err := Restore(e2, "Password"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if e2.Password != "saved secret" {
+		t.Fatalf("restore should decrypt the field, got %q", e2.Password)
+	}
+}
@@ -0,0 +1,135 @@
+package orr
+
+// 地理位置索引
+//
+// 两种声明方式:
+//   1. 一对float64字段: Lat float64 `orr:"geo=lat"`, Lng float64 `orr:"geo=lng"`
+//   2. GeoPoint类型的字段: Loc GeoPoint `orr:"geo"`
+// 每个类型的位置保存在GEO key(结构名:geo)中, member为obj.Id.
+// 经纬度都为0时认为对象没有位置, 不加入索引.
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"reflect"
+	"strconv"
+)
+
+type GeoPoint struct {
+	Lat float64
+	Lng float64
+}
+
+var geoPointType = reflect.TypeOf(GeoPoint{})
+
+func geoKey(name string) string {
+	return redisKey(name, ":geo")
+}
+
+// 返回obj的经纬度; ok为false时表示类型没有geo字段或obj没有位置
+func (m *model) geo(rv reflect.Value) (lat, lng float64, ok bool, err error) {
+	var hasLat, hasLng bool
+	for _, f := range m.fields {
+		if !f.has("geo") {
+			continue
+		}
+		fv := rv.Field(f.index)
+		switch {
+		case f.typ == geoPointType:
+			p := fv.Interface().(GeoPoint)
+			lat, lng, hasLat, hasLng = p.Lat, p.Lng, true, true
+		case f.opts["geo"] == "lat" && fv.Kind() == reflect.Float64:
+			lat, hasLat = fv.Float(), true
+		case f.opts["geo"] == "lng" && fv.Kind() == reflect.Float64:
+			lng, hasLng = fv.Float(), true
+		default:
+			return 0, 0, false, fmt.Errorf("field %s: geo field must be GeoPoint or float64 with geo=lat/geo=lng.", f.name)
+		}
+	}
+	if !hasLat && !hasLng {
+		return 0, 0, false, nil
+	}
+	if hasLat != hasLng {
+		return 0, 0, false, fmt.Errorf("type %s must have both geo=lat and geo=lng fields.", m.name)
+	}
+	if lat == 0 && lng == 0 {
+		return 0, 0, false, nil
+	}
+	// redis GEO支持的经纬度范围
+	if lat < -85.05112878 || lat > 85.05112878 || lng < -180 || lng > 180 {
+		return 0, 0, false, fmt.Errorf("invalid coordinate lat %f, lng %f.", lat, lng)
+	}
+	return lat, lng, true, nil
+}
+
+func (m *model) hasGeo() bool {
+	for _, f := range m.fields {
+		if f.has("geo") {
+			return true
+		}
+	}
+	return false
+}
+
+// Nearby返回类型name中距离(lat, lng)在radius米之内的对象, 按距离由近到远追加到res中
+// 返回的距离(米)与追加到res中的对象一一对应; limit为0时返回所有结果
+func Nearby(name string, lat, lng, radius float64, limit int, res interface{}) ([]float64, error) {
+	rtelem, isPtr, err := resultElem(res)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []interface{}{geoKey(name), lng, lat, radius, "m", "WITHDIST"}
+	if limit > 0 {
+		args = append(args, "COUNT", limit)
+	}
+	args = append(args, "ASC")
+
+	conns := allConns()
+	defer closeConns(conns)
+	lists := make([][]hit, len(conns))
+	for shard, conn := range conns {
+		items, err := redis.Values(conn.Do("GEORADIUS", args...))
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			pair, err := redis.Values(item, nil)
+			if err != nil || len(pair) != 2 {
+				return nil, fmt.Errorf("unexpected GEORADIUS reply %v.", item)
+			}
+			dist, err := strconv.ParseFloat(string(pair[1].([]byte)), 64)
+			if err != nil {
+				return nil, err
+			}
+			lists[shard] = append(lists[shard], hit{id: pair[0], score: dist, shard: shard})
+		}
+	}
+	// 多个分片时按距离合并
+	hits := mergeHits(lists, false, 0, limit)
+	if len(hits) == 0 {
+		return nil, nil
+	}
+
+	replies, err := hmgetHits(conns, name, hits)
+	if err != nil {
+		return nil, err
+	}
+
+	var distances []float64
+	slice := reflect.ValueOf(res).Elem()
+	for i, reply := range replies {
+		if reply == nil {
+			continue
+		}
+		v, err := decodeElem(reply.([]byte), rtelem, isPtr)
+		if err != nil {
+			return nil, err
+		}
+		slice = reflect.Append(slice, v)
+		distances = append(distances, hits[i].score)
+	}
+	reflect.ValueOf(res).Elem().Set(slice)
+
+	return distances, nil
+}
@@ -0,0 +1,53 @@
+package orr
+
+import (
+	"testing"
+)
+
+type Tgeo struct {
+	Id   int64
+	Name string
+	Lat  float64 `orr:"geo=lat"`
+	Lng  float64 `orr:"geo=lng"`
+}
+
+type Tgeopoint struct {
+	Id  int64
+	Loc GeoPoint `orr:"geo"`
+}
+
+func TestNearby(t *testing.T) {
+	objs := []interface{}{
+		&Tgeo{Name: "tiananmen", Lat: 39.9087, Lng: 116.3975},
+		&Tgeo{Name: "wangfujing", Lat: 39.9151, Lng: 116.4109},
+		&Tgeo{Name: "shanghai", Lat: 31.2304, Lng: 121.4737},
+		&Tgeo{Name: "nowhere"},
+	}
+	if _, errs := InsertMany(objs, false); errs[0] != nil {
+		t.Fatal(errs[0].Error())
+	}
+	defer DeleteMany(objs)
+
+	var res []Tgeo
+	dists, err := Nearby("tgeo", 39.9088, 116.3976, 5000, 10, &res)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(res) != 2 || len(dists) != 2 || res[0].Name != "tiananmen" || dists[0] > dists[1] {
+		t.Fatal("Nearby returns wrong data", res, dists)
+	}
+
+	p := &Tgeopoint{Loc: GeoPoint{Lat: 31.23, Lng: 121.47}}
+	if _, err = Insert(p, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer Delete(p)
+	var ps []*Tgeopoint
+	if _, err = Nearby("tgeopoint", 31.23, 121.47, 100, 0, &ps); err != nil || len(ps) != 1 {
+		t.Fatal("Nearby with GeoPoint failed")
+	}
+
+	if _, err = Insert(&Tgeo{Lat: 100, Lng: 10}, false); err == nil {
+		t.Fatal("invalid coordinate should fail")
+	}
+}
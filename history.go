@@ -0,0 +1,132 @@
+package orr
+
+// 对象的历史版本
+//
+// 通过Register(obj, WithHistory(n))开启. 每次Insert, Update, Delete时, 将写操作之前的对象数据
+// 及操作时间, 操作类型, 操作者记录到list(结构名:history:obj.Id)的头部, 最多保留n个版本.
+// 记录与写操作在同一个事务中写入.
+//
+// 操作者通过context传递:
+//   ctx := orr.WithActor(context.Background(), "admin")
+//   orr.UpdateContext(ctx, &u, "tuser", u.Id)
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// 保留的历史版本不足以确定对象在某一时刻的数据
+var ErrHistoryTruncated = errors.New("history truncated, object state at the time is unknown.")
+
+type actorKey struct{}
+
+// WithActor返回携带操作者的context
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom返回context中的操作者
+func ActorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// Revision为一次写操作的记录
+type Revision struct {
+	Tm    time.Time       // 操作时间
+	Op    string          // insert, update, delete, undelete
+	Actor string          // 操作者
+	Data  json.RawMessage `json:",omitempty"` // 操作之前的对象数据, 操作之前对象不存在时为空
+}
+
+func historyKey(name string, sid string) string {
+	return redisKey(name, ":history:"+sid)
+}
+
+// 记录历史版本, prev为写操作之前的对象, 无效值表示对象不存在
+// 返回错误时写操作失败, 不会写入没有历史记录的数据
+func (m *model) historyCommands(ctx context.Context, t *tx, op string, sid string, prev reflect.Value) error {
+	if m.history <= 0 {
+		return nil
+	}
+
+	rev := Revision{Tm: now(), Op: op, Actor: ActorFrom(ctx)}
+	if prev.IsValid() {
+		sealed, err := m.seal(prev)
+		if err != nil {
+			return err
+		}
+		buf, err := json.Marshal(sealed.Interface())
+		if err != nil {
+			return err
+		}
+		rev.Data = buf
+	}
+	buf, err := json.Marshal(&rev)
+	if err != nil {
+		return err
+	}
+
+	key := historyKey(m.name, sid)
+	t.add("LPUSH", key, buf)
+	t.add("LTRIM", key, 0, m.history-1)
+	return nil
+}
+
+// History返回对象的历史版本, 按时间从新到旧
+func History(name string, id int64) ([]Revision, error) {
+	conn, err := objReadConn(name, id)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	items, err := redis.ByteSlices(conn.Do("LRANGE", historyKey(name, strconv.FormatInt(id, 10)), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	revs := make([]Revision, len(items))
+	for i, item := range items {
+		if err = json.Unmarshal(item, &revs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return revs, nil
+}
+
+// SelectAt读取对象在tm时刻的数据; 对象在tm时刻不存在时返回ErrNotFound
+// tm早于保留的最早版本, 且最早版本不是对象的创建时, 返回ErrHistoryTruncated
+func SelectAt(name string, id int64, tm time.Time, res interface{}) error {
+	revs, err := History(name, id)
+	if err != nil {
+		return err
+	}
+
+	// tm时刻的数据为tm之后第一次写操作之前的数据
+	var (
+		after *Revision
+		i     int
+	)
+	for i = 0; i < len(revs); i++ {
+		if !revs[i].Tm.After(tm) {
+			break
+		}
+		after = &revs[i]
+	}
+	if after == nil {
+		return Select(id, name, res)
+	}
+	if len(after.Data) == 0 {
+		return ErrNotFound
+	}
+	// 最早版本之前的写操作已被LTRIM删除, 其记录的数据不一定是tm时刻的数据
+	if i == len(revs) {
+		return ErrHistoryTruncated
+	}
+	return decodeObject(after.Data, res)
+}
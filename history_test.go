@@ -0,0 +1,130 @@
+package orr
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type Thistory struct {
+	Id   int64
+	Name string
+}
+
+type Thistorytrim struct {
+	Id   int64
+	Name string
+}
+
+// JSON编码失败, 历史版本无法记录
+type historyFail int
+
+func (historyFail) MarshalJSON() ([]byte, error) {
+	return nil, errors.New("marshal failed")
+}
+
+type Thistoryfail struct {
+	Id   int64
+	Name string
+	Bad  historyFail
+}
+
+func TestHistory(t *testing.T) {
+	Register(Thistory{}, WithHistory(10))
+
+	u := &Thistory{Name: "v1"}
+	if _, err := Insert(u, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	time.Sleep(5 * time.Millisecond)
+	t1 := time.Now()
+	time.Sleep(5 * time.Millisecond)
+
+	u.Name = "v2"
+	ctx := WithActor(context.Background(), "admin")
+	if err := UpdateContext(ctx, u, "thistory", u.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	time.Sleep(5 * time.Millisecond)
+	t2 := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	if err := Delete(u); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	revs, err := History("thistory", u.Id)
+	if err != nil || len(revs) != 3 {
+		t.Fatal("History should have 3 revisions")
+	}
+	if revs[0].Op != "delete" || revs[1].Op != "update" || revs[1].Actor != "admin" || revs[2].Data != nil {
+		t.Fatal("History returns wrong revisions", revs)
+	}
+
+	var v Thistory
+	if err = SelectAt("thistory", u.Id, t1, &v); err != nil || v.Name != "v1" {
+		t.Fatal("SelectAt t1 should be v1")
+	}
+	if err = SelectAt("thistory", u.Id, t2, &v); err != nil || v.Name != "v2" {
+		t.Fatal("SelectAt t2 should be v2")
+	}
+	if err = SelectAt("thistory", u.Id, time.Now(), &v); err != ErrNotFound {
+		t.Fatal("object is deleted now")
+	}
+	if err = SelectAt("thistory", u.Id, t1.Add(-time.Hour), &v); err != ErrNotFound {
+		t.Fatal("object does not exist before insert")
+	}
+}
+
+func TestHistoryTruncated(t *testing.T) {
+	Register(Thistorytrim{}, WithHistory(2))
+
+	u := &Thistorytrim{Name: "v1"}
+	if _, err := Insert(u, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer Delete(u)
+	time.Sleep(5 * time.Millisecond)
+	t1 := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	for _, name := range []string{"v2", "v3"} {
+		u.Name = name
+		if err := Update(u, "thistorytrim", u.Id); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// 只保留2个版本, insert的记录已被删除
+	var v Thistorytrim
+	if err := SelectAt("thistorytrim", u.Id, t1, &v); err != ErrHistoryTruncated {
+		t.Fatal("SelectAt before the oldest revision should return ErrHistoryTruncated")
+	}
+}
+
+func TestHistoryFail(t *testing.T) {
+	Register(Thistoryfail{}, WithHistory(5), WithCodec(MsgPack))
+
+	u := &Thistoryfail{Name: "v1"}
+	if _, err := Insert(u, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	u.Name = "v2"
+	if err := Update(u, "thistoryfail", u.Id); err == nil {
+		t.Fatal("update should fail when history cannot be recorded")
+	}
+	if err := Delete(u); err == nil {
+		t.Fatal("delete should fail when history cannot be recorded")
+	}
+	var u2 Thistoryfail
+	if err := Select(u.Id, "thistoryfail", &u2); err != nil || u2.Name != "v1" {
+		t.Fatal("object should not be changed without history")
+	}
+	if revs, err := History("thistoryfail", u.Id); err != nil || len(revs) != 1 {
+		t.Fatal("only the insert should be recorded")
+	}
+	conn := rpool.Get()
+	defer conn.Close()
+	conn.Do("HDEL", "thistoryfail", u.Id)
+	conn.Do("DEL", historyKey("thistoryfail", strconv.FormatInt(u.Id, 10)))
+}
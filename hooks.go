@@ -0,0 +1,86 @@
+package orr
+
+// 生命周期钩子
+//
+// 对象实现以下接口时, orr在相应的时机调用:
+//   BeforeInsert: Insert, InsertMany写入之前, 返回错误时不写入
+//   AfterInsert:  Insert, InsertMany写入成功之后, 对象的Id已设置
+//   BeforeUpdate: Update写入之前, 返回错误时不写入
+//   AfterDelete:  Delete, DeleteMany删除成功之后
+//   AfterLoad:    Select, SelectMany, List, Query, Search等读取对象之后
+// After钩子返回的错误作为操作的错误返回, 但写操作已经完成.
+// 钩子通常定义在struct的Ptr上, 以便修改对象:
+//   func (u *Tuser) BeforeInsert() error {
+//       u.Password = hash(u.Password)
+//       return nil
+//   }
+
+import (
+	"reflect"
+)
+
+type BeforeInserter interface {
+	BeforeInsert() error
+}
+
+type AfterInserter interface {
+	AfterInsert() error
+}
+
+type BeforeUpdater interface {
+	BeforeUpdate() error
+}
+
+type AfterDeleter interface {
+	AfterDelete() error
+}
+
+type AfterLoader interface {
+	AfterLoad() error
+}
+
+func beforeInsert(obj interface{}) error {
+	if h, ok := obj.(BeforeInserter); ok {
+		return h.BeforeInsert()
+	}
+	return nil
+}
+
+func afterInsert(obj interface{}) error {
+	if h, ok := obj.(AfterInserter); ok {
+		return h.AfterInsert()
+	}
+	return nil
+}
+
+func beforeUpdate(obj interface{}) error {
+	if h, ok := obj.(BeforeUpdater); ok {
+		return h.BeforeUpdate()
+	}
+	return nil
+}
+
+func afterDelete(obj interface{}) error {
+	if h, ok := obj.(AfterDeleter); ok {
+		return h.AfterDelete()
+	}
+	return nil
+}
+
+func afterLoad(obj interface{}) error {
+	if h, ok := obj.(AfterLoader); ok {
+		return h.AfterLoad()
+	}
+	return nil
+}
+
+// 返回obj的Ptr, 使定义在Ptr上的钩子也能被调用; obj不是Ptr时返回其拷贝的Ptr
+func addressable(obj interface{}) interface{} {
+	rv := reflect.ValueOf(obj)
+	if rv.Kind() == reflect.Ptr {
+		return obj
+	}
+	pv := reflect.New(rv.Type())
+	pv.Elem().Set(rv)
+	return pv.Interface()
+}
@@ -0,0 +1,79 @@
+package orr
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type Thook struct {
+	Id       int64
+	Name     string `orr:"index"`
+	Password string
+	Upper    string `json:"-"`
+}
+
+var thookDeleted []int64
+
+func (h *Thook) BeforeInsert() error {
+	if h.Name == "" {
+		return errors.New("name is required")
+	}
+	h.Password = "hashed:" + h.Password
+	return nil
+}
+
+func (h *Thook) BeforeUpdate() error {
+	if !strings.HasPrefix(h.Password, "hashed:") {
+		h.Password = "hashed:" + h.Password
+	}
+	return nil
+}
+
+func (h *Thook) AfterDelete() error {
+	thookDeleted = append(thookDeleted, h.Id)
+	return nil
+}
+
+func (h *Thook) AfterLoad() error {
+	h.Upper = strings.ToUpper(h.Name)
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	if _, err := Insert(&Thook{}, false); err == nil {
+		t.Fatal("BeforeInsert should abort Insert")
+	}
+
+	h := &Thook{Name: "hook", Password: "secret"}
+	if _, err := Insert(h, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	var h2 Thook
+	if err := Select(h.Id, "thook", &h2); err != nil {
+		t.Fatal(err.Error())
+	}
+	if h2.Password != "hashed:secret" || h2.Upper != "HOOK" {
+		t.Fatalf("hooks not applied: %+v", h2)
+	}
+
+	// 非Ptr的对象也调用Ptr上的钩子
+	h2.Password = "new"
+	if err := Update(h2, "thook", h2.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	var hs []Thook
+	if errs, err := SelectMany([]int64{h.Id}, "thook", &hs); err != nil || errs[0] != nil {
+		t.Fatal("SelectMany failed")
+	}
+	if hs[0].Password != "hashed:new" || hs[0].Upper != "HOOK" {
+		t.Fatalf("hooks not applied: %+v", hs[0])
+	}
+
+	if err := Delete(h2); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(thookDeleted) != 1 || thookDeleted[0] != h.Id {
+		t.Fatal("AfterDelete should be called")
+	}
+}
@@ -1,6 +1,7 @@
 package orr
 
 import (
+	"strings"
 	"sync"
 )
 
@@ -49,6 +50,22 @@ func ReturnId(name string, id int64) {
 	idmap.reuse[name] = append(idmap.reuse[name], id)
 }
 
+// 删除名称以prefix开始的所有Id序列
+func resetIds(prefix string) {
+	idmap.Lock()
+	defer idmap.Unlock()
+	for name := range idmap.ids {
+		if strings.HasPrefix(name, prefix) {
+			delete(idmap.ids, name)
+		}
+	}
+	for name := range idmap.reuse {
+		if strings.HasPrefix(name, prefix) {
+			delete(idmap.reuse, name)
+		}
+	}
+}
+
 func restoreid() {
 
 }
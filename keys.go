@@ -0,0 +1,80 @@
+package orr
+
+// redis key的命名
+//
+// orr生成的所有key都由类型名及后缀组成: 主hashmap为 tuser, 辅助hashmap为 tuser_email,
+// 创建时间zset为 tuser:created, KeyField为 tuser_fn_Id 等.
+// KeyNamer根据类型名及后缀生成最终的key, 默认在前面加上全局前缀:
+//   orr.SetKeyPrefix("app1:")   // app1:tuser, app1:tuser_email, ...
+//
+// 类型名默认为结构名的小写, 不同package中的同名结构会使用相同的key,
+// 此时应通过Register(obj, WithName(name))或者结构的OrrName()方法指定类型名.
+
+import (
+	"strings"
+	"sync"
+)
+
+type KeyNamer interface {
+	// name为类型名, suffix为key的后缀, 主hashmap的后缀为空
+	Key(name, suffix string) string
+}
+
+// KeyNamerFunc将函数转换为KeyNamer
+type KeyNamerFunc func(name, suffix string) string
+
+func (f KeyNamerFunc) Key(name, suffix string) string {
+	return f(name, suffix)
+}
+
+type prefixNamer string
+
+func (p prefixNamer) Key(name, suffix string) string {
+	return string(p) + name + suffix
+}
+
+var namer = struct {
+	sync.RWMutex
+	n KeyNamer
+}{n: prefixNamer("")}
+
+// SetKeyNamer设置生成key的KeyNamer, n为nil时恢复默认; 应在程序启动时调用
+func SetKeyNamer(n KeyNamer) {
+	if n == nil {
+		n = prefixNamer("")
+	}
+	namer.Lock()
+	namer.n = n
+	namer.Unlock()
+}
+
+// SetKeyPrefix设置所有key的全局前缀
+func SetKeyPrefix(prefix string) {
+	SetKeyNamer(prefixNamer(prefix))
+}
+
+func redisKey(name, suffix string) string {
+	namer.RLock()
+	n := namer.n
+	namer.RUnlock()
+	return n.Key(name, suffix)
+}
+
+// 类型的主hashmap
+func hashKey(name string) string {
+	return redisKey(name, "")
+}
+
+// 字段相关的key的后缀: _字段名, 字段名小写且去掉_
+func fieldSuffix(fieldName string) string {
+	return "_" + strings.Replace(strings.ToLower(fieldName), "_", "", -1)
+}
+
+// KeyField的key, typ为key时每个对象一个key, 为hash时所有对象保存在一个hashmap中
+func keyFieldKey(name, fn, sid string) string {
+	return redisKey(name, "_"+fn+"_"+sid)
+}
+
+func keyFieldHashKey(name, fn string) string {
+	return redisKey(name, "_"+fn)
+}
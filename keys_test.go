@@ -0,0 +1,119 @@
+package orr
+
+import (
+	"testing"
+)
+
+type Tkeys struct {
+	Id   int64
+	Name string `orr:"index"`
+}
+
+// 与Tkeys使用相同的类型名
+type Tkeysclash struct {
+	Id int64
+}
+
+func (Tkeysclash) OrrName() string {
+	return "tkeys"
+}
+
+// 未Register的类型使用相同的类型名, 如billing.Account与auth.Account
+type Tkeysauto1 struct {
+	Id int64
+}
+
+func (Tkeysauto1) OrrName() string {
+	return "tkeysauto"
+}
+
+type Tkeysauto2 struct {
+	Id int64
+}
+
+func (Tkeysauto2) OrrName() string {
+	return "tkeysauto"
+}
+
+type Tkeysnamed struct {
+	Id int64
+}
+
+func TestKeyNames(t *testing.T) {
+	if err := Register(&Tkeys{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Register(&Tkeysclash{}); err == nil {
+		t.Fatal("Register should report type name collision")
+	}
+	if err := Register(&Tkeysclash{}, WithName("billing_tkeys")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Register(&Tkeysnamed{}, WithName("tkeys")); err == nil {
+		t.Fatal("WithName should not use a name of another type")
+	}
+
+	SetKeyPrefix("app1:")
+	defer SetKeyPrefix("")
+
+	k := &Tkeys{Name: "prefixed"}
+	if _, err := Insert(k, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	c := &Tkeysclash{}
+	if _, err := Insert(c, false); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	conn := rpool.Get()
+	defer conn.Close()
+	for _, key := range []string{"app1:tkeys", "app1:tkeys_name", "app1:tkeys:created", "app1:billing_tkeys"} {
+		if n, _ := conn.Do("EXISTS", key); n.(int64) != 1 {
+			t.Fatalf("key %s should exist", key)
+		}
+	}
+	if n, _ := conn.Do("EXISTS", "tkeys"); n.(int64) != 0 {
+		t.Fatal("keys should be prefixed")
+	}
+
+	var k2 Tkeys
+	if err := Select(k.Id, "tkeys", &k2); err != nil || k2.Name != "prefixed" {
+		t.Fatal("Select should use prefixed key")
+	}
+	if id, _ := SelectIndex("tkeys", "name", "prefixed"); id != k.Id {
+		t.Fatal("SelectIndex should use prefixed key")
+	}
+
+	SetKeyNamer(KeyNamerFunc(func(name, suffix string) string {
+		return "{" + name + "}" + suffix
+	}))
+	if _, err := Insert(&Tkeys{Name: "tagged"}, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n, _ := conn.Do("EXISTS", "{tkeys}_name"); n.(int64) != 1 {
+		t.Fatal("KeyNamer should control index keys")
+	}
+}
+
+func TestAutoNameClash(t *testing.T) {
+	a := &Tkeysauto1{}
+	if _, err := Insert(a, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer Delete(a)
+	b := &Tkeysauto2{}
+	if _, err := Insert(b, false); err == nil {
+		t.Fatal("type name collision of unregistered types should fail")
+	}
+	if err := NewQuery(Tkeysauto2{}).Find(&[]Tkeysauto2{}); err == nil {
+		t.Fatal("query on a clashing type should fail")
+	}
+
+	if err := Register(&Tkeysauto2{}, WithName("tkeysauto2")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := Insert(b, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	Delete(b)
+}
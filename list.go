@@ -0,0 +1,162 @@
+package orr
+
+// 遍历某类型的所有对象
+//   List: 基于主hashmap的HSCAN, 顺序不固定, 遍历过程中增删的对象可能被遗漏或重复返回
+//   ListOrdered: 基于按创建时间排序的zset(结构名:created), 由Insert维护
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// 按创建时间排序的zset, score为创建时间(毫秒), member为obj.Id
+func createdKey(name string) string {
+	return redisKey(name, ":created")
+}
+
+func createdScore() int64 {
+	return now().UnixNano() / int64(time.Millisecond)
+}
+
+// Count返回类型name的对象数量
+func Count(name string) (int64, error) {
+	return sumShards(func(conn redis.Conn) (int64, error) {
+		return redis.Int64(conn.Do("HLEN", hashKey(name)))
+	})
+}
+
+// List使用HSCAN遍历类型name的对象, 结果追加到res中
+// res必须为slice的Ptr, slice的元素为struct或struct的Ptr
+// cursor首次调用时为0, 返回的cursor为0时表示遍历结束
+// count仅为redis的建议值, 每次返回的对象数量可能多于或少于count
+// 使用Shards时依次遍历每个分片, cursor的高8位为分片的序号
+func List(name string, cursor uint64, count int, res interface{}) (uint64, error) {
+	rtelem, isPtr, err := resultElem(res)
+	if err != nil {
+		return 0, err
+	}
+	if count <= 0 {
+		count = 10
+	}
+
+	conns := allConns()
+	defer closeConns(conns)
+	shard := int(cursor >> shardCursorShift)
+	if shard >= len(conns) {
+		return 0, nil
+	}
+	conn := conns[shard]
+	cursor &= 1<<shardCursorShift - 1
+	reply, err := redis.Values(conn.Do("HSCAN", hashKey(name), cursor, "COUNT", count))
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) != 2 {
+		return 0, fmt.Errorf("unexpected HSCAN reply length %d.", len(reply))
+	}
+	next, err := strconv.ParseUint(string(reply[0].([]byte)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	kvs, err := redis.Values(reply[1], nil)
+	if err != nil {
+		return 0, err
+	}
+
+	ids := make([]interface{}, 0, len(kvs)/2)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		ids = append(ids, kvs[i])
+	}
+	flags, err := expiredFlags(conn, name, ids)
+	if err != nil {
+		return 0, err
+	}
+
+	slice := reflect.ValueOf(res).Elem()
+	for i := 1; i < len(kvs); i += 2 {
+		if flags[i/2] {
+			continue
+		}
+		v, err := decodeElem(kvs[i].([]byte), rtelem, isPtr)
+		if err != nil {
+			return 0, err
+		}
+		slice = reflect.Append(slice, v)
+	}
+	reflect.ValueOf(res).Elem().Set(slice)
+
+	if next != 0 {
+		next |= uint64(shard) << shardCursorShift
+	} else if shard+1 < len(conns) {
+		next = uint64(shard+1) << shardCursorShift
+	}
+	return next, nil
+}
+
+// ListOrdered按创建时间从早到晚遍历类型name的对象, 结果追加到res中
+// cursor为已遍历的对象数, 首次调用时为0, 返回的cursor为0时表示遍历结束
+// 在该功能之前插入的对象不在创建时间zset中, 不会被返回
+// 使用Shards时每个分片读取前cursor+count个对象的id, 合并后分页, cursor越大开销越大
+func ListOrdered(name string, cursor uint64, count int, res interface{}) (uint64, error) {
+	rtelem, isPtr, err := resultElem(res)
+	if err != nil {
+		return 0, err
+	}
+	if count <= 0 {
+		count = 10
+	}
+
+	conns := allConns()
+	defer closeConns(conns)
+	start, n := shardWindow(len(conns), int(cursor), count)
+	lists := make([][]hit, len(conns))
+	for i, conn := range conns {
+		items, err := redis.Values(conn.Do("ZRANGE", createdKey(name),
+			start, start+n-1, "WITHSCORES"))
+		if err != nil {
+			return 0, err
+		}
+		if lists[i], err = scoredHits(items, i); err != nil {
+			return 0, err
+		}
+	}
+	hits := mergeHits(lists, false, int(cursor), count)
+	if len(hits) == 0 {
+		return 0, nil
+	}
+
+	replies, err := hmgetHits(conns, name, hits)
+	if err != nil {
+		return 0, err
+	}
+	if err = appendObjects(replies, res, rtelem, isPtr); err != nil {
+		return 0, err
+	}
+
+	if len(hits) < count {
+		return 0, nil
+	}
+	return cursor + uint64(len(hits)), nil
+}
+
+// 将HMGET读取的对象追加到res中; 已不存在或已过期的对象(nil)被跳过
+func appendObjects(replies []interface{}, res interface{}, rtelem reflect.Type, isPtr bool) error {
+	slice := reflect.ValueOf(res).Elem()
+	for _, reply := range replies {
+		// 索引与主hashmap不一致或对象已过期时, 跳过该对象
+		if reply == nil {
+			continue
+		}
+		v, err := decodeElem(reply.([]byte), rtelem, isPtr)
+		if err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, v)
+	}
+	reflect.ValueOf(res).Elem().Set(slice)
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package orr
+
+import (
+	"testing"
+)
+
+type Tlist struct {
+	Id   int64
+	Name string
+}
+
+func TestList(t *testing.T) {
+	objs := []interface{}{
+		&Tlist{Name: "l1"}, &Tlist{Name: "l2"}, &Tlist{Name: "l3"},
+	}
+	if _, errs := InsertMany(objs, false); errs[0] != nil {
+		t.Fatal(errs[0].Error())
+	}
+
+	n, err := Count("tlist")
+	if err != nil || n != 3 {
+		t.Fatal("Count should be 3")
+	}
+
+	var (
+		all    []Tlist
+		cursor uint64
+	)
+	for {
+		cursor, err = List("tlist", cursor, 2, &all)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if len(all) != 3 {
+		t.Fatal("List should return 3 objects")
+	}
+
+	var ordered []*Tlist
+	cursor, err = ListOrdered("tlist", 0, 2, &ordered)
+	if err != nil || cursor != 2 || len(ordered) != 2 {
+		t.Fatal("ListOrdered first page wrong")
+	}
+	cursor, err = ListOrdered("tlist", cursor, 2, &ordered)
+	if err != nil || cursor != 0 || len(ordered) != 3 || ordered[2].Name != "l3" {
+		t.Fatal("ListOrdered second page wrong")
+	}
+
+	DeleteMany(objs)
+}
@@ -0,0 +1,425 @@
+package orr
+
+// 结构体的元数据
+//
+// orr tag可以包含多个选项, 以;分隔, 选项可以带值: `orr:"index;range"`, `orr:"opt=value"`
+//   index: 唯一索引, 辅助hashmap(结构名_字段名), field为字段值, value为obj.Id
+//   set:   集合索引, 每个字段值对应一个set(结构名_字段名:set:字段值), member为obj.Id
+//   range: 范围索引, 数值字段对应一个zset(结构名_字段名:range), score为字段值, member为obj.Id
+//   text:  全文索引, 见text.go
+//   prefix: 前缀索引, 用于自动补全, 见prefix.go
+//   geo:   地理位置索引, 见geo.go
+//   bitmap: bool字段的bitmap索引, 见bitmap.go
+//   tags:  []string字段的标签索引, 见tags.go
+//   count: 按字段值分组计数, 见count.go
+//   softdelete: 软删除时间字段, 见softdelete.go
+//   created, updated, default: 自动时间戳及默认值, 见timestamps.go
+//   encrypt: 字段加密, 见encrypt.go
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type field struct {
+	name  string // 结构体字段名
+	key   string // 用于redis key的字段名, 小写且去掉_
+	index int
+	typ   reflect.Type
+	opts  map[string]string
+	rules *rules // valid tag定义的约束, 见validate.go
+}
+
+func (f *field) has(opt string) bool {
+	_, ok := f.opts[opt]
+	return ok
+}
+
+type model struct {
+	name   string
+	typ    reflect.Type
+	fields []*field
+	byName map[string]*field
+
+	ttl     time.Duration // 对象的默认存活时间, 0表示不过期
+	history int           // 保留的历史版本数, 0表示不记录历史
+	codec   Codec         // 类型使用的Codec, nil表示使用全局的Codec, 见codec.go
+
+	encrypted bool   // 是否有加密字段, 见encrypt.go
+	tenant    string // 租户, name包含租户前缀, 见tenant.go
+	err       error  // 类型名已被其他类型使用, 见getModel
+
+	soft        *field // 软删除时间字段, 见softdelete.go
+	softReserve bool   // 软删除的对象是否保留唯一索引的值
+}
+
+var models = struct {
+	sync.Mutex
+	m      map[reflect.Type]*model
+	byName map[string]*model
+}{
+	m:      make(map[reflect.Type]*model),
+	byName: make(map[string]*model),
+}
+
+// Register的选项
+type Option func(*model)
+
+// WithTTL设置类型的默认存活时间, Insert的对象在ttl之后过期, 见ttl.go
+func WithTTL(ttl time.Duration) Option {
+	return func(m *model) {
+		m.ttl = ttl
+	}
+}
+
+// WithHistory记录类型的历史版本, 每个对象最多保留retention个版本, 见history.go
+func WithHistory(retention int) Option {
+	return func(m *model) {
+		m.history = retention
+	}
+}
+
+// WithName指定类型名, 类型的所有key及按类型名调用的函数都使用该名称, 见keys.go
+func WithName(name string) Option {
+	return func(m *model) {
+		m.name = name
+	}
+}
+
+// 结构实现Namer时, 使用OrrName()的返回值作为类型名
+type Namer interface {
+	OrrName() string
+}
+
+// Register注册类型并设置选项, obj为struct或struct的Ptr
+// 未注册的类型在第一次使用时自动注册, 使用默认选项;
+// 后台任务(如过期清理)只处理已注册的类型, 因此应在程序启动时注册所有类型
+func Register(obj interface{}, opts ...Option) error {
+	rt := reflect.TypeOf(obj)
+	if rt != nil && rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if rt == nil || rt.Kind() != reflect.Struct {
+		return fmt.Errorf("Param obj must be struct type.")
+	}
+	if _, ok := rt.FieldByName("Id"); !ok {
+		return errors.New("Param obj must has Id field.")
+	}
+
+	m := getModel(rt)
+	models.Lock()
+	defer models.Unlock()
+	name, nameErr := m.name, m.err
+	// 选项出错时设置m.err
+	m.err = nil
+	for _, opt := range opts {
+		opt(m)
+	}
+	if err := m.err; err != nil {
+		m.name, m.err = name, nameErr
+		return err
+	}
+	// 不同的类型不能使用相同的类型名, 否则会写入相同的key
+	if other, ok := models.byName[m.name]; ok && other != m {
+		m.name = name
+		return nameError(other)
+	}
+	if models.byName[name] == m {
+		delete(models.byName, name)
+	}
+	models.byName[m.name] = m
+	m.err = nil
+	return nil
+}
+
+func nameError(other *model) error {
+	return fmt.Errorf("type name %s is used by %s, use WithName or OrrName to specify another name.",
+		other.name, other.typ)
+}
+
+// 类型名与其他类型冲突时返回错误, 所有写操作之前检查
+func (m *model) checkName() error {
+	models.Lock()
+	defer models.Unlock()
+	return m.err
+}
+
+// 按类型名查找已注册的类型, name可以是租户的类型名
+func modelByName(name string) (*model, bool) {
+	tenant, base := splitScopedName(name)
+	models.Lock()
+	m, ok := models.byName[base]
+	models.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return m.scoped(tenant), true
+}
+
+// 所有已注册的类型
+func allModels() []*model {
+	models.Lock()
+	defer models.Unlock()
+	all := make([]*model, 0, len(models.m))
+	for _, m := range models.m {
+		all = append(all, m)
+	}
+	return all
+}
+
+// 返回结构体类型的元数据, typ可以是struct或struct的Ptr
+func getModel(typ reflect.Type) *model {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	models.Lock()
+	defer models.Unlock()
+	if m, ok := models.m[typ]; ok {
+		return m
+	}
+
+	m := &model{
+		name:   getTypeName(typ),
+		typ:    typ,
+		byName: make(map[string]*field),
+	}
+	if n, ok := reflect.New(typ).Interface().(Namer); ok {
+		m.name = n.OrrName()
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		structfield := typ.Field(i)
+		if structfield.Anonymous {
+			continue
+		}
+
+		f := &field{
+			name:  structfield.Name,
+			key:   strings.Replace(strings.ToLower(structfield.Name), "_", "", -1),
+			index: i,
+			typ:   structfield.Type,
+			opts:  parseOrrTag(structfield.Tag.Get("orr")),
+			rules: parseRules(structfield.Tag.Get("valid")),
+		}
+		m.fields = append(m.fields, f)
+		m.byName[f.name] = f
+		m.byName[f.key] = f
+		if f.has("encrypt") {
+			m.encrypted = true
+		}
+		if f.has("softdelete") {
+			m.soft = f
+			m.softReserve = f.opts["softdelete"] == "reserve"
+		}
+	}
+	models.m[typ] = m
+	// 类型名冲突时保留先使用的类型, 后使用的类型的操作返回错误, 直到用Register指定其他的类型名
+	if other, ok := models.byName[m.name]; ok {
+		m.err = nameError(other)
+	} else {
+		models.byName[m.name] = m
+	}
+
+	return m
+}
+
+// 解析orr tag, 选项以;分隔, 选项的值以=分隔
+func parseOrrTag(tag string) map[string]string {
+	opts := make(map[string]string)
+	if tag == "" || tag == "-" {
+		return opts
+	}
+	for _, opt := range strings.Split(tag, ";") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		k := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) == 2 {
+			opts[k] = strings.TrimSpace(kv[1])
+		} else {
+			opts[k] = ""
+		}
+	}
+	return opts
+}
+
+// 查找字段, name可以是结构体字段名或者小写的字段名
+func (m *model) field(name string) (*field, error) {
+	f, ok := m.byName[name]
+	if !ok {
+		f, ok = m.byName[strings.Replace(strings.ToLower(name), "_", "", -1)]
+	}
+	if !ok {
+		return nil, fmt.Errorf("type %s has no field %s.", m.name, name)
+	}
+	return f, nil
+}
+
+func setKey(name string, f *field, value string) string {
+	return redisKey(name, fieldSuffix(f.name)+":set:"+value)
+}
+
+func rangeKey(name string, f *field) string {
+	return redisKey(name, fieldSuffix(f.name)+":range")
+}
+
+// 添加obj的辅助索引
+func (m *model) addIndexes(t *tx, sid string, rv reflect.Value) error {
+	return m.add(t, sid, rv, true)
+}
+
+// 删除obj的辅助索引
+func (m *model) removeIndexes(t *tx, sid string, rv reflect.Value) {
+	m.remove(t, sid, rv, true)
+}
+
+// 由旧值old更新为rv时的辅助索引: 删除旧值的索引后添加新值的索引, tags字段按差异更新
+func (m *model) updateIndexes(t *tx, sid string, old, rv reflect.Value) error {
+	m.remove(t, sid, old, false)
+	if err := m.add(t, sid, rv, false); err != nil {
+		return err
+	}
+	for _, f := range m.fields {
+		if f.has("tags") {
+			if err := m.diffTags(t, f, sid, old.Field(f.index), rv.Field(f.index)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *model) add(t *tx, sid string, rv reflect.Value, withTags bool) error {
+	for _, f := range m.fields {
+		fv := rv.Field(f.index)
+		if f.has("index") && fv.String() != "" {
+			v, err := m.indexValue(f, fv.String())
+			if err != nil {
+				return err
+			}
+			t.add("HSET", indexKey(m.name, f.name), v, sid)
+		}
+		if f.has("set") {
+			t.add("SADD", setKey(m.name, f, valueString(fv)), sid)
+		}
+		if f.has("range") {
+			score, err := scoreOf(fv.Interface())
+			if err != nil {
+				return fmt.Errorf("field %s: %s", f.name, err.Error())
+			}
+			t.add("ZADD", rangeKey(m.name, f), score, sid)
+		}
+		if f.has("text") && fv.Kind() == reflect.String {
+			m.addText(t, sid, fv.String())
+		}
+		if f.has("prefix") && fv.Kind() == reflect.String && fv.String() != "" {
+			t.add("ZADD", prefixKey(m.name, f.name), 0, prefixMember(fv.String(), sid))
+		}
+		if f.has("bitmap") {
+			if fv.Kind() != reflect.Bool {
+				return fmt.Errorf("bitmap field %s must be bool type.", f.name)
+			}
+			if fv.Bool() {
+				t.add("SETBIT", bitmapKey(m.name, f.name), sid, 1)
+			}
+		}
+		if f.has("tags") && withTags {
+			if err := m.diffTags(t, f, sid, reflect.Value{}, fv); err != nil {
+				return err
+			}
+		}
+		if f.has("count") {
+			t.add("HINCRBY", countKey(m.name, f.name), valueString(fv), 1)
+		}
+	}
+
+	lat, lng, ok, err := m.geo(rv)
+	if err != nil {
+		return err
+	}
+	if ok {
+		t.add("GEOADD", geoKey(m.name), lng, lat, sid)
+	}
+	return nil
+}
+
+func (m *model) remove(t *tx, sid string, rv reflect.Value, withTags bool) {
+	for _, f := range m.fields {
+		fv := rv.Field(f.index)
+		if f.has("index") && fv.String() != "" {
+			if v, err := m.indexValue(f, fv.String()); err == nil {
+				t.add("HDEL", indexKey(m.name, f.name), v)
+			}
+		}
+		if f.has("set") {
+			t.add("SREM", setKey(m.name, f, valueString(fv)), sid)
+		}
+		if f.has("range") {
+			t.add("ZREM", rangeKey(m.name, f), sid)
+		}
+		if f.has("text") && fv.Kind() == reflect.String {
+			m.removeText(t, sid, fv.String())
+		}
+		if f.has("prefix") && fv.Kind() == reflect.String && fv.String() != "" {
+			t.add("ZREM", prefixKey(m.name, f.name), prefixMember(fv.String(), sid))
+		}
+		if f.has("bitmap") {
+			t.add("SETBIT", bitmapKey(m.name, f.name), sid, 0)
+		}
+		if f.has("tags") && withTags {
+			m.removeTags(t, f, sid, fv)
+		}
+		if f.has("count") {
+			t.add("HINCRBY", countKey(m.name, f.name), valueString(fv), -1)
+		}
+	}
+
+	if m.hasGeo() {
+		t.add("ZREM", geoKey(m.name), sid)
+	}
+}
+
+// 字段值转换为字符串, 用于组成set索引的key
+func valueString(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// 数值转换为zset的score; time.Time转换为unix时间(秒)
+func scoreOf(v interface{}) (float64, error) {
+	if t, ok := v.(time.Time); ok {
+		return float64(t.Unix()), nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.Bool:
+		if rv.Bool() {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("value of type %T cannot be used as score.", v)
+}
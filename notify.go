@@ -0,0 +1,201 @@
+package orr
+
+// 变更通知
+//
+// 每次写操作成功后, 在类型的channel(结构名:events)及对象的channel(结构名:events:Id)
+// 上发布一条通知, 内容为json格式的Event. PUBLISH与写操作在同一个事务中执行.
+//
+// Watch及WatchType订阅通知, 连接断开时自动重连; 断开期间的通知会丢失,
+// 需要可靠地处理所有变更时应使用变更流, 见changes.go
+// 使用Shards时订阅所有分片并合并通知; AddShard之后需要重新Watch才能收到新分片中的对象的通知.
+//
+//   events, stop := orr.Watch("tuser", id)
+//   defer stop()
+//   for e := range events {
+//       ...
+//   }
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 重连的等待时间
+const (
+	minWatchBackoff = 100 * time.Millisecond
+	maxWatchBackoff = 5 * time.Second
+)
+
+var errWatchStopped = errors.New("watch stopped.")
+
+func typeChannel(name string) string {
+	return redisKey(name, ":events")
+}
+
+func objectChannel(name, sid string) string {
+	return typeChannel(name) + ":" + sid
+}
+
+func notifyCommands(t *tx, name string, sid string, op string, fields []string, payload []byte) {
+	id, _ := strconv.ParseInt(sid, 10, 64)
+	buf, err := json.Marshal(&Event{
+		Type:    name,
+		Id:      id,
+		Op:      op,
+		Fields:  fields,
+		Payload: payload,
+	})
+	if err != nil {
+		return
+	}
+	t.add("PUBLISH", typeChannel(name), buf)
+	t.add("PUBLISH", objectChannel(name, sid), buf)
+}
+
+// Watch订阅类型name中对象id的变更通知, 调用stop取消订阅并关闭返回的channel
+func Watch(name string, id int64) (<-chan Event, func()) {
+	return watch(objectChannel(name, strconv.FormatInt(id, 10)))
+}
+
+// WatchType订阅类型name中所有对象的变更通知, 调用stop取消订阅并关闭返回的channel
+func WatchType(name string) (<-chan Event, func()) {
+	return watch(typeChannel(name))
+}
+
+// 订阅通知使用的连接; 使用Shards时通知发布在对象所在的分片, 因此订阅每个分片
+// 集群中的通知会发送到所有节点, 直接使用一个节点的连接: 停止订阅时在另一个goroutine中
+// 发送UNSUBSCRIBE, clusterConn的状态不能被并发访问
+func watchConns() []func() redis.Conn {
+	if c, ok := rpool.(*Cluster); ok {
+		return []func() redis.Conn{func() redis.Conn { return c.pool(c.addrOf(0)).Get() }}
+	}
+	s, ok := rpool.(*Shards)
+	if !ok {
+		return []func() redis.Conn{func() redis.Conn { return rpool.Get() }}
+	}
+	var gets []func() redis.Conn
+	for _, addr := range s.Addrs() {
+		p := s.pool(addr)
+		gets = append(gets, func() redis.Conn { return p.Get() })
+	}
+	return gets
+}
+
+// 一个连接上的订阅, 连接断开时自动重连
+type subscription struct {
+	mu    sync.Mutex
+	cur   *redis.PubSubConn // 当前的订阅连接, 重连等待期间为nil
+	ready chan struct{}     // 第一次订阅完成(或失败)时关闭
+	once  sync.Once
+}
+
+func watch(channel string) (<-chan Event, func()) {
+	var (
+		events = make(chan Event, 16)
+		done   = make(chan struct{})
+		wg     sync.WaitGroup
+		subs   []*subscription
+	)
+	for _, get := range watchConns() {
+		sub := &subscription{ready: make(chan struct{})}
+		subs = append(subs, sub)
+		wg.Add(1)
+		go func(get func() redis.Conn) {
+			defer wg.Done()
+			sub.run(get, channel, events, done)
+		}(get)
+	}
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+
+	// 等待第一次订阅完成, 之后的写操作都能收到通知
+	for _, sub := range subs {
+		<-sub.ready
+	}
+
+	var stopOnce sync.Once
+	return events, func() {
+		stopOnce.Do(func() {
+			close(done)
+			for _, sub := range subs {
+				sub.stop()
+			}
+		})
+	}
+}
+
+func (sub *subscription) setReady() {
+	sub.once.Do(func() { close(sub.ready) })
+}
+
+func (sub *subscription) run(get func() redis.Conn, channel string, events chan<- Event, done <-chan struct{}) {
+	backoff := minWatchBackoff
+	for {
+		sub.mu.Lock()
+		select {
+		case <-done:
+			sub.mu.Unlock()
+			return
+		default:
+		}
+		c := &redis.PubSubConn{Conn: get()}
+		sub.cur = c
+		err := c.Subscribe(channel)
+		sub.mu.Unlock()
+
+		for err == nil {
+			switch v := c.Receive().(type) {
+			case redis.Message:
+				var e Event
+				if json.Unmarshal(v.Data, &e) != nil {
+					continue
+				}
+				select {
+				case events <- e:
+				case <-done:
+					err = errWatchStopped
+				}
+			case redis.Subscription:
+				if v.Kind == "subscribe" {
+					backoff = minWatchBackoff
+					sub.setReady()
+				}
+				if v.Count == 0 {
+					err = errWatchStopped
+				}
+			case error:
+				err = v
+			}
+		}
+
+		sub.mu.Lock()
+		sub.cur = nil
+		sub.mu.Unlock()
+		c.Close()
+		sub.setReady()
+
+		select {
+		case <-done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+	}
+}
+
+// 取消订阅使Receive返回, 调用之前已关闭done
+func (sub *subscription) stop() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.cur != nil {
+		sub.cur.Unsubscribe()
+	}
+}
@@ -0,0 +1,68 @@
+package orr
+
+import (
+	"testing"
+	"time"
+)
+
+type Tnotify struct {
+	Id   int64
+	Name string
+}
+
+func TestWatch(t *testing.T) {
+	u := &Tnotify{Name: "n1"}
+	if _, err := Insert(u, false); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	events, stop := Watch("tnotify", u.Id)
+	all, stopAll := WatchType("tnotify")
+	defer stopAll()
+
+	u.Name = "n2"
+	if err := Update(u, "tnotify", u.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	other := &Tnotify{Name: "other"}
+	if _, err := Insert(other, false); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	select {
+	case e := <-events:
+		var n Tnotify
+		if e.Op != "update" || e.Id != u.Id || e.Decode(&n) != nil || n.Name != "n2" {
+			t.Fatalf("unexpected event: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Watch should receive the update")
+	}
+	for _, op := range []string{"update", "insert"} {
+		select {
+		case e := <-all:
+			if e.Op != op {
+				t.Fatalf("WatchType should receive %s, got %s", op, e.Op)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("WatchType should receive all events of the type")
+		}
+	}
+
+	// 只收到该对象的通知
+	select {
+	case e := <-events:
+		t.Fatalf("Watch should not receive events of other objects: %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stop()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("channel should be closed after stop")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel should be closed after stop")
+	}
+}
@@ -4,18 +4,35 @@ package orr
 // currently, mainly support map, slice, array, struct
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"reflect"
-	//"strconv"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// Pool为redis连接的来源, 单机使用redis.Pool, 集群使用Cluster, 哨兵模式使用Sentinel
+type Pool interface {
+	Get() redis.Conn
+}
+
+// 支持从replica读取的Pool
+type replicaPool interface {
+	GetReplica() redis.Conn
+}
+
+// 只读操作使用的连接
+func readConn() redis.Conn {
+	if p, ok := rpool.(replicaPool); ok {
+		return p.GetReplica()
+	}
+	return rpool.Get()
+}
+
 var (
-	rpool *redis.Pool
+	rpool Pool
 )
 
 func OpenRedis(proto, addr string) {
@@ -52,6 +69,10 @@ func OpenRedis(proto, addr string) {
 
 // 将数据结构Marshal, 并保存
 func Save(obj interface{}, fieldname string) error {
+	return save("", obj, fieldname)
+}
+
+func save(tenant string, obj interface{}, fieldname string) error {
 	if fieldname[0] < 'A' || fieldname[0] > 'Z' {
 		return fmt.Errorf("Param obj's field %s should be exported.\n", fieldname)
 	}
@@ -61,7 +82,7 @@ func Save(obj interface{}, fieldname string) error {
 
 	if tobj.Kind() == reflect.Ptr {
 		vobj = vobj.Elem()
-		tobj = reflect.TypeOf(vobj)
+		tobj = vobj.Type()
 	}
 
 	if tobj.Kind() != reflect.Struct {
@@ -79,27 +100,60 @@ func Save(obj interface{}, fieldname string) error {
 	}
 	iid := vid.Int()
 
-	typName := getTypeName(tobj)
-	if strings.Contains(typName, "-") {
+	if err := getModel(tobj).checkName(); err != nil {
+		return err
+	}
+	m := getModel(tobj).scoped(tenant)
+	typName := m.name
+	// 租户名可以包含-, 只检查类型名
+	if strings.Contains(m.baseName(), "-") {
 		return errors.New("Struct name should not contains -.")
 	}
 
-	redisFieldname := typName + "_" + strings.ToLower(fieldname)
+	redisFieldname := redisKey(typName, "_"+strings.ToLower(fieldname))
 
-	buf, err := json.Marshal(vfield.Interface())
+	value := vfield.Interface()
+	// 加密字段保存密文, 见encrypt.go
+	if f, err := m.field(fieldname); err == nil && f.has("encrypt") {
+		if err = m.checkEncrypt(f); err != nil {
+			return err
+		}
+		if vfield.String() != "" {
+			if value, err = m.encrypt(f, vfield.String()); err != nil {
+				return err
+			}
+		}
+	}
+	buf, err := getModel(tobj).encode(value)
 	if err != nil {
-		return fmt.Errorf("Marshal field %s failed: %s.", err.Error())
+		return fmt.Errorf("Marshal field %s failed: %s.", fieldname, err.Error())
 	}
-	err = hsetToRedis(redisFieldname, iid, buf, "map")
+	sid := strconv.FormatInt(iid, 10)
+	t := &tx{}
+	t.add("HSET", redisFieldname, sid, buf)
+	// 与KeyField相同, 对象过期时一并删除
+	t.add("SADD", keyFieldsKey(typName), "hash:"+strings.ToLower(fieldname))
+	changeCommand(t, typName, sid, "save", []string{fieldname}, buf)
+
+	conn, err := objConn(typName, iid)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	defer conn.Close()
+	_, err = t.exec(conn)
+	if redirected(err) {
+		// 集群正在迁移slot, 更新slot表后重试一次
+		_, err = t.exec(conn)
+	}
+	return err
 }
 
 // 从redis中恢复数据
 func Restore(obj interface{}, fieldname string) error {
+	return restore("", obj, fieldname)
+}
+
+func restore(tenant string, obj interface{}, fieldname string) error {
 	if fieldname[0] < 'A' || fieldname[0] > 'Z' {
 		return fmt.Errorf("Param obj's field %s should be exported.\n", fieldname)
 	}
@@ -125,19 +179,36 @@ func Restore(obj interface{}, fieldname string) error {
 	}
 	iid := vid.Int()
 
-	typName := getTypeName(tobj)
-	redisFieldname := typName + "_" + strings.ToLower(fieldname)
+	if err := getModel(tobj).checkName(); err != nil {
+		return err
+	}
+	m := getModel(tobj).scoped(tenant)
+	typName := m.name
+	redisFieldname := redisKey(typName, "_"+strings.ToLower(fieldname))
 
 	if !vfield.CanSet() {
 		return fmt.Errorf("Param obj field %s cannot be set.\n", fieldname)
 	}
 
-	res, err := hgetFromRedis(redisFieldname, iid, vfield.Type())
+	conn, err := objReadConn(typName, iid)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	res, err := hgetFromRedis(conn, redisFieldname, iid, vfield.Type())
 	if err != nil {
 		return fmt.Errorf("Get obj's field %s data from redis failed: %s.\n",
 			fieldname, err.Error())
 	}
-	vfield.Set(reflect.ValueOf(res).Elem())
+	rv := reflect.ValueOf(res).Elem()
+	if f, err := m.field(fieldname); err == nil && f.has("encrypt") && rv.Kind() == reflect.String {
+		plain, err := m.decrypt(f, rv.String())
+		if err != nil {
+			return err
+		}
+		rv.SetString(plain)
+	}
+	vfield.Set(rv)
 
 	return nil
 }
@@ -173,11 +244,9 @@ func RemElement(obj interface{}, fieldname string, args ...interface{}) error {
 	return nil
 }
 
-func hgetFromRedis(key string, field interface{}, typ reflect.Type) (interface{}, error) {
+func hgetFromRedis(conn redis.Conn, key string, field interface{}, typ reflect.Type) (interface{}, error) {
 	res := reflect.New(typ).Interface()
 
-	conn := rpool.Get()
-	defer conn.Close()
 	buf, err := conn.Do("HGET", key, field)
 	if err != nil {
 		return nil, err
@@ -185,7 +254,7 @@ func hgetFromRedis(key string, field interface{}, typ reflect.Type) (interface{}
 	if buf == nil {
 		return nil, fmt.Errorf("value of key %s & field %q is nil.\n", key, field)
 	}
-	err = json.Unmarshal(buf.([]byte), &res)
+	err = decodeValue(buf.([]byte), res)
 	if err != nil {
 		return nil, err
 	}
@@ -204,6 +273,13 @@ func hsetToRedis(key string, field interface{}, value []byte, typ string) error
 	return nil
 }
 
+func zaddToRedis(key string, score int64, member interface{}) error {
+	conn := rpool.Get()
+	defer conn.Close()
+	_, err := conn.Do("ZADD", key, score, member)
+	return err
+}
+
 func hdelFromRedis(key string, field interface{}, typ string) {
 	conn := rpool.Get()
 	defer conn.Close()
@@ -0,0 +1,70 @@
+package orr
+
+// 前缀索引, 用于自动补全
+//
+// tag为prefix的string字段保存在zset(结构名_字段名:prefix)中, 所有member的score均为0,
+// member为 小写的字段值\x00字段值\x00obj.Id, 通过ZRANGEBYLEX按前缀查询, 不区分大小写
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Completion struct {
+	Value string
+	Id    int64
+}
+
+func prefixKey(name string, fieldName string) string {
+	return redisKey(name, fieldSuffix(fieldName)+":prefix")
+}
+
+func prefixMember(value string, sid string) string {
+	return strings.ToLower(value) + "\x00" + value + "\x00" + sid
+}
+
+// Complete返回类型name的字段field中以prefix开头的值及其对象Id, 按字段值排序
+// limit为0时返回所有结果
+func Complete(name, field, prefix string, limit int) ([]Completion, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	prefix = strings.ToLower(prefix)
+
+	conns := allConns()
+	defer closeConns(conns)
+	var members []string
+	for _, conn := range conns {
+		// UTF-8编码中不会出现0xff, 作为前缀范围的上界
+		m, err := redis.Strings(conn.Do("ZRANGEBYLEX", prefixKey(name, field),
+			"["+prefix, "["+prefix+"\xff", "LIMIT", 0, limit))
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m...)
+	}
+	// 合并各分片的结果, member的字典序即ZRANGEBYLEX的顺序
+	if len(conns) > 1 {
+		sort.Strings(members)
+		if limit > 0 && len(members) > limit {
+			members = members[:limit]
+		}
+	}
+
+	res := make([]Completion, 0, len(members))
+	for _, member := range members {
+		parts := strings.Split(member, "\x00")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid prefix index member %q.", member)
+		}
+		id, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, Completion{Value: parts[1], Id: id})
+	}
+	return res, nil
+}
@@ -0,0 +1,43 @@
+package orr
+
+import (
+	"testing"
+)
+
+type Tprefix struct {
+	Id   int64
+	Name string `orr:"prefix"`
+}
+
+func TestComplete(t *testing.T) {
+	objs := []interface{}{
+		&Tprefix{Name: "guotie"}, &Tprefix{Name: "Guest"},
+		&Tprefix{Name: "gao"}, &Tprefix{Name: "铁哥"},
+	}
+	ids, errs := InsertMany(objs, false)
+	if errs[0] != nil {
+		t.Fatal(errs[0].Error())
+	}
+	defer DeleteMany(objs)
+
+	res, err := Complete("tprefix", "Name", "gu", 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(res) != 2 || res[0].Value != "Guest" || res[1].Id != ids[0] {
+		t.Fatal("Complete returns wrong data", res)
+	}
+
+	if res, _ = Complete("tprefix", "name", "铁", 10); len(res) != 1 {
+		t.Fatal("Complete CJK prefix failed")
+	}
+
+	u := objs[0].(*Tprefix)
+	u.Name = "tiege"
+	if err = Update(u, "tprefix", u.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	if res, _ = Complete("tprefix", "name", "gu", 0); len(res) != 1 {
+		t.Fatal("prefix index is not updated")
+	}
+}
@@ -0,0 +1,340 @@
+package orr
+
+// 基于索引的查询
+//
+//   var users []Tuser
+//   err := NewQuery(Tuser{}).Where("IpAddr", "=", ip).Where("DaysLogin", ">", 5).
+//       OrderBy("Tm").Limit(20).Find(&users)
+//
+// 每个条件都必须能使用字段的索引:
+//   =:            index(唯一索引), set或range
+//   >, >=, <, <=: range
+// 各条件的结果保存在临时key中, 通过ZINTERSTORE求交集;
+// 有OrderBy时按该字段的range索引排序, 否则通过SORT按Id排序
+// 使用Shards时在每个分片中查询前offset+limit个结果, 合并排序后分页
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"reflect"
+	"strconv"
+)
+
+const tmpKeyTTL = 60
+
+type predicate struct {
+	f     *field
+	op    string
+	value interface{}
+}
+
+type Query struct {
+	m      *model
+	preds  []predicate
+	order  *field
+	desc   bool
+	offset int
+	limit  int
+	err    error
+}
+
+// NewQuery创建一个查询, obj为被查询的struct或struct的Ptr, 仅用于确定类型
+func NewQuery(obj interface{}) *Query {
+	rt := reflect.TypeOf(obj)
+	if rt != nil && rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if rt == nil || rt.Kind() != reflect.Struct {
+		return &Query{err: fmt.Errorf("Param obj must be struct type.")}
+	}
+	m := getModel(rt)
+	return &Query{m: m, err: m.checkName()}
+}
+
+// Where增加一个查询条件, 多个条件之间为AND关系
+func (q *Query) Where(fieldname, op string, value interface{}) *Query {
+	if q.err != nil {
+		return q
+	}
+	f, err := q.m.field(fieldname)
+	if err != nil {
+		q.err = err
+		return q
+	}
+
+	switch op {
+	case "=", "==":
+		if !f.has("index") && !f.has("set") && !f.has("range") {
+			q.err = fmt.Errorf("field %s has no index, cannot query with %s.", f.name, op)
+			return q
+		}
+		op = "="
+	case ">", ">=", "<", "<=":
+		if !f.has("range") {
+			q.err = fmt.Errorf("field %s has no range index, cannot query with %s.", f.name, op)
+			return q
+		}
+	default:
+		q.err = fmt.Errorf("query operator %s is not supported.", op)
+		return q
+	}
+	// 只能通过range索引计算的条件, value必须为数值
+	if op != "=" || (!f.has("index") && !f.has("set")) {
+		if _, err := scoreOf(value); err != nil {
+			q.err = fmt.Errorf("field %s: %s", f.name, err.Error())
+			return q
+		}
+	}
+
+	q.preds = append(q.preds, predicate{f, op, value})
+	return q
+}
+
+// OrderBy按字段升序排列, 字段必须有range索引
+func (q *Query) OrderBy(fieldname string) *Query {
+	return q.orderBy(fieldname, false)
+}
+
+// OrderByDesc按字段降序排列, 字段必须有range索引
+func (q *Query) OrderByDesc(fieldname string) *Query {
+	return q.orderBy(fieldname, true)
+}
+
+func (q *Query) orderBy(fieldname string, desc bool) *Query {
+	if q.err != nil {
+		return q
+	}
+	f, err := q.m.field(fieldname)
+	if err != nil {
+		q.err = err
+		return q
+	}
+	if !f.has("range") {
+		q.err = fmt.Errorf("field %s has no range index, cannot order by it.", f.name)
+		return q
+	}
+	q.order, q.desc = f, desc
+	return q
+}
+
+// Limit限制返回的对象数量, 0表示不限制
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+func (q *Query) Offset(n int) *Query {
+	q.offset = n
+	return q
+}
+
+// Find执行查询, 结果追加到res中
+// res必须为slice的Ptr, slice的元素为struct或struct的Ptr
+func (q *Query) Find(res interface{}) error {
+	if q.err != nil {
+		return q.err
+	}
+	rtelem, isPtr, err := resultElem(res)
+	if err != nil {
+		return err
+	}
+	if rtelem != q.m.typ {
+		return fmt.Errorf("element of param res must be %s.", q.m.typ)
+	}
+
+	conns := allConns()
+	defer closeConns(conns)
+	hits, err := q.hits(conns)
+	if err != nil || len(hits) == 0 {
+		return err
+	}
+	replies, err := hmgetHits(conns, q.m.name, hits)
+	if err != nil {
+		return err
+	}
+	return appendObjects(replies, res, rtelem, isPtr)
+}
+
+// Ids执行查询, 仅返回符合条件的对象Id
+func (q *Query) Ids() ([]int64, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	conns := allConns()
+	defer closeConns(conns)
+	hits, err := q.hits(conns)
+	if err != nil {
+		return nil, err
+	}
+	return hitIds(hits), nil
+}
+
+// 在每个分片中执行查询, 合并后分页
+func (q *Query) hits(conns []redis.Conn) ([]hit, error) {
+	offset, limit := shardWindow(len(conns), q.offset, q.limit)
+	lists := make([][]hit, len(conns))
+	for i, conn := range conns {
+		hits, err := q.ids(conn, i, offset, limit)
+		if err != nil {
+			return nil, err
+		}
+		lists[i] = hits
+	}
+	return mergeHits(lists, q.desc, q.offset, q.limit), nil
+}
+
+// 在分片shard中查询, 返回第offset个开始的limit个结果
+func (q *Query) ids(conn redis.Conn, shard, offset, limit int) ([]hit, error) {
+	var (
+		keys []interface{}
+		tmps []interface{}
+	)
+	defer func() {
+		if len(tmps) > 0 {
+			conn.Do("DEL", tmps...)
+		}
+	}()
+
+	for _, p := range q.preds {
+		key, empty, err := q.evalPredicate(conn, p, &tmps)
+		if err != nil {
+			return nil, err
+		}
+		if empty {
+			return nil, nil
+		}
+		keys = append(keys, key)
+	}
+
+	// 没有条件时, 以创建时间zset作为全集
+	if len(keys) == 0 {
+		keys = append(keys, createdKey(q.m.name))
+	}
+
+	weights := make([]interface{}, len(keys))
+	for i := range weights {
+		weights[i] = 0
+	}
+	if q.order != nil {
+		keys = append(keys, rangeKey(q.m.name, q.order))
+		weights = append(weights, 1)
+	}
+
+	dest := tmpKey(q.m.name)
+	tmps = append(tmps, dest)
+	args := []interface{}{dest, len(keys)}
+	args = append(args, keys...)
+	args = append(args, "WEIGHTS")
+	args = append(args, weights...)
+	conn.Send("ZINTERSTORE", args...)
+	conn.Send("EXPIRE", dest, tmpKeyTTL)
+	if err := receiveAll(conn, 2); err != nil {
+		return nil, err
+	}
+
+	if q.order == nil {
+		args = []interface{}{dest}
+		if limit > 0 || offset > 0 {
+			if limit <= 0 {
+				limit = -1
+			}
+			args = append(args, "LIMIT", offset, limit)
+		}
+		ids, err := redis.Values(conn.Do("SORT", args...))
+		if err != nil {
+			return nil, err
+		}
+		return idHits(ids, shard), nil
+	}
+
+	stop := -1
+	if limit > 0 {
+		stop = offset + limit - 1
+	}
+	cmd := "ZRANGE"
+	if q.desc {
+		cmd = "ZREVRANGE"
+	}
+	items, err := redis.Values(conn.Do(cmd, dest, offset, stop, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	return scoredHits(items, shard)
+}
+
+// 计算单个条件, 返回保存结果的key; empty为true时表示结果为空
+func (q *Query) evalPredicate(conn redis.Conn, p predicate,
+	tmps *[]interface{}) (key string, empty bool, err error) {
+	name := q.m.name
+	f := p.f
+
+	if p.op == "=" && f.has("index") {
+		v, err := q.m.indexValue(f, fmt.Sprint(p.value))
+		if err != nil {
+			return "", false, err
+		}
+		reply, err := conn.Do("HGET", indexKey(name, f.name), v)
+		if err != nil || reply == nil {
+			return "", true, err
+		}
+		key = tmpKey(name)
+		*tmps = append(*tmps, key)
+		conn.Send("SADD", key, reply)
+		conn.Send("EXPIRE", key, tmpKeyTTL)
+		return key, false, receiveAll(conn, 2)
+	}
+
+	if p.op == "=" && f.has("set") {
+		return setKey(name, f, valueString(reflect.ValueOf(p.value))), false, nil
+	}
+
+	// range索引: ZRANGEBYSCORE读取范围内的member, 保存到临时set; 开销与结果的数量成正比
+	score, _ := scoreOf(p.value)
+	s := strconv.FormatFloat(score, 'f', -1, 64)
+	min, max := "-inf", "+inf"
+	switch p.op {
+	case "=":
+		min, max = s, s
+	case ">=":
+		min = s
+	case ">":
+		min = "(" + s
+	case "<=":
+		max = s
+	case "<":
+		max = "(" + s
+	}
+	ids, err := redis.Values(conn.Do("ZRANGEBYSCORE", rangeKey(name, f), min, max))
+	if err != nil || len(ids) == 0 {
+		return "", true, err
+	}
+	key = tmpKey(name)
+	*tmps = append(*tmps, key)
+	conn.Send("SADD", append([]interface{}{key}, ids...)...)
+	conn.Send("EXPIRE", key, tmpKeyTTL)
+	return key, false, receiveAll(conn, 2)
+}
+
+// flush并读取n个返回, 返回第一个错误
+func receiveAll(conn redis.Conn, n int) error {
+	err := conn.Flush()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if _, e := conn.Receive(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// 查询类型name使用的临时key
+func tmpKey(name string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return redisKey(name, ":tmp:"+hex.EncodeToString(b))
+}
@@ -0,0 +1,71 @@
+package orr
+
+import (
+	"testing"
+)
+
+type Tquery struct {
+	Id        int64
+	Name      string `orr:"index"`
+	IpAddr    string `orr:"set"`
+	DaysLogin int    `orr:"range"`
+	Tm        int64  `orr:"range"`
+}
+
+func TestQuery(t *testing.T) {
+	objs := []interface{}{
+		&Tquery{Name: "q1", IpAddr: "10.0.0.1", DaysLogin: 3, Tm: 300},
+		&Tquery{Name: "q2", IpAddr: "10.0.0.1", DaysLogin: 8, Tm: 200},
+		&Tquery{Name: "q3", IpAddr: "10.0.0.2", DaysLogin: 9, Tm: 100},
+		&Tquery{Name: "q4", IpAddr: "10.0.0.1", DaysLogin: 6, Tm: 400},
+	}
+	if _, errs := InsertMany(objs, true); errs[0] != nil {
+		t.Fatal(errs[0].Error())
+	}
+	defer DeleteMany(objs)
+
+	var res []Tquery
+	err := NewQuery(Tquery{}).Where("IpAddr", "=", "10.0.0.1").
+		Where("DaysLogin", ">", 5).OrderBy("Tm").Limit(20).Find(&res)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(res) != 2 || res[0].Name != "q2" || res[1].Name != "q4" {
+		t.Fatal("query returns wrong data", res)
+	}
+
+	ids, err := NewQuery(&Tquery{}).Where("Name", "=", "q3").Ids()
+	if err != nil || len(ids) != 1 {
+		t.Fatal("query by unique index failed")
+	}
+
+	// Update后索引随之更新
+	q1 := objs[0].(*Tquery)
+	q1.DaysLogin = 10
+	if err = Update(q1, "tquery", q1.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	ids, err = NewQuery(Tquery{}).Where("DaysLogin", ">=", 9).Ids()
+	if err != nil || len(ids) != 2 {
+		t.Fatal("range index is not updated")
+	}
+
+	if ids, err = NewQuery(Tquery{}).Where("DaysLogin", "<", 3).Ids(); err != nil || len(ids) != 0 {
+		t.Fatal("empty range should return no ids")
+	}
+
+	// 不存在的对象不能通过Update写入, 否则会覆盖其他对象的唯一索引
+	if err = Update(&Tquery{Name: "q3"}, "tquery", 99999); err != ErrNotFound {
+		t.Fatal("update unknown id should return ErrNotFound")
+	}
+	if id, _ := SelectIndex("tquery", "name", "q3"); id != objs[2].(*Tquery).Id {
+		t.Fatal("update unknown id should not overwrite unique index")
+	}
+
+	if err = NewQuery(Tquery{}).Where("Tm", "!=", 1).Find(&res); err == nil {
+		t.Fatal("unsupported operator should fail")
+	}
+	if _, err = NewQuery(Tquery{}).Where("Id", "=", 1).Ids(); err == nil {
+		t.Fatal("field without index should fail")
+	}
+}
@@ -0,0 +1,330 @@
+package orr
+
+// Redis Sentinel
+//
+//   err := orr.OpenSentinel("mymaster", []string{"10.0.0.1:26379", "10.0.0.2:26379"}, true)
+//
+// Sentinel向sentinel查询master的地址, 所有写操作发送到master.
+// 连接出错或收到READONLY(master已降级为replica)时, 重新向sentinel查询master;
+// 收到READONLY且不在事务中的命令在新的master上重试一次; 网络错误时命令可能已经执行, 不重试;
+// 事务中的命令返回错误, 由调用者重试.
+//
+// ReadReplicas为true时, Select, SelectIndex, Restore, SelectKeyField从replica读取.
+// replica的复制是异步的, 刚写入的数据可能读不到, 需要读己之写时不要开启ReadReplicas.
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 两次查询sentinel的最小间隔, 避免故障切换期间大量连接同时查询
+const resolveInterval = 100 * time.Millisecond
+
+type Sentinel struct {
+	// master的名字, 即sentinel monitor配置中的名字
+	MasterName string
+	// sentinel的地址
+	Addrs []string
+	// 只读操作是否从replica读取
+	ReadReplicas bool
+	// Dial创建到redis的连接, 默认为redis.Dial("tcp", addr)
+	Dial func(addr string) (redis.Conn, error)
+
+	mu       sync.RWMutex
+	master   string
+	pool     *redis.Pool
+	replicas []string
+	rpools   map[string]*redis.Pool
+	resolved time.Time
+	next     uint32
+}
+
+// NewSentinel向sentinel查询master及replica的地址
+func NewSentinel(masterName string, addrs []string) (*Sentinel, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("at least one sentinel address is required.")
+	}
+	s := &Sentinel{
+		MasterName: masterName,
+		Addrs:      append([]string{}, addrs...),
+		Dial: func(addr string) (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+		rpools: make(map[string]*redis.Pool),
+	}
+	if err := s.Resolve(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenSentinel连接sentinel管理的master, readReplicas为true时只读操作从replica读取
+func OpenSentinel(masterName string, addrs []string, readReplicas bool) error {
+	s, err := NewSentinel(masterName, addrs)
+	if err != nil {
+		return err
+	}
+	s.ReadReplicas = readReplicas
+	conn := s.Get()
+	defer conn.Close()
+	if _, err = conn.Do("PING"); err != nil {
+		return err
+	}
+	rpool = s
+	return nil
+}
+
+func (s *Sentinel) newPool(addr string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 600 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return s.Dial(addr)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+// Resolve重新查询master及replica的地址, master变化时关闭旧master的连接池
+func (s *Sentinel) Resolve() error {
+	var (
+		master   string
+		replicas []string
+		err      error
+	)
+	s.mu.RLock()
+	addrs := append([]string{}, s.Addrs...)
+	s.mu.RUnlock()
+	for _, addr := range addrs {
+		master, replicas, err = s.query(addr)
+		if err == nil {
+			s.prefer(addr)
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("resolve master %s failed: %v", s.MasterName, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resolved = time.Now()
+	if master != s.master {
+		if s.pool != nil {
+			s.pool.Close()
+		}
+		s.master = master
+		s.pool = s.newPool(master)
+	}
+
+	live := make(map[string]bool)
+	for _, addr := range replicas {
+		live[addr] = true
+		if _, ok := s.rpools[addr]; !ok {
+			s.rpools[addr] = s.newPool(addr)
+		}
+	}
+	for addr, p := range s.rpools {
+		if !live[addr] {
+			p.Close()
+			delete(s.rpools, addr)
+		}
+	}
+	s.replicas = replicas
+	return nil
+}
+
+// 向一个sentinel查询master及可用的replica
+func (s *Sentinel) query(addr string) (string, []string, error) {
+	conn, err := redis.DialTimeout("tcp", addr, time.Second, time.Second, time.Second)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+
+	reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.MasterName))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(reply) != 2 {
+		return "", nil, fmt.Errorf("master %s is unknown to sentinel %s.", s.MasterName, addr)
+	}
+	master := reply[0] + ":" + reply[1]
+
+	// redis 5.0之前的sentinel只支持SLAVES
+	items, err := redis.Values(conn.Do("SENTINEL", "replicas", s.MasterName))
+	if err != nil {
+		items, err = redis.Values(conn.Do("SENTINEL", "slaves", s.MasterName))
+	}
+	if err != nil {
+		return master, nil, nil
+	}
+	var replicas []string
+	for _, item := range items {
+		info, err := redis.StringMap(item, nil)
+		if err != nil {
+			continue
+		}
+		flags := info["flags"]
+		if strings.Contains(flags, "s_down") || strings.Contains(flags, "o_down") ||
+			strings.Contains(flags, "disconnected") {
+			continue
+		}
+		replicas = append(replicas, info["ip"]+":"+info["port"])
+	}
+	return master, replicas, nil
+}
+
+// Master返回当前master的地址
+func (s *Sentinel) Master() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.master
+}
+
+// Replicas返回当前可用的replica的地址
+func (s *Sentinel) Replicas() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string{}, s.replicas...)
+}
+
+// Get返回到master的连接
+func (s *Sentinel) Get() redis.Conn {
+	s.mu.RLock()
+	p := s.pool
+	s.mu.RUnlock()
+	return &sentinelConn{Conn: p.Get(), s: s}
+}
+
+// GetReplica返回到replica的连接, 未开启ReadReplicas或没有可用的replica时返回到master的连接
+func (s *Sentinel) GetReplica() redis.Conn {
+	if !s.ReadReplicas {
+		return s.Get()
+	}
+	s.mu.RLock()
+	var p *redis.Pool
+	if n := len(s.replicas); n > 0 {
+		p = s.rpools[s.replicas[int(atomic.AddUint32(&s.next, 1))%n]]
+	}
+	s.mu.RUnlock()
+	if p == nil {
+		return s.Get()
+	}
+	conn := p.Get()
+	if conn.Err() != nil {
+		conn.Close()
+		return s.Get()
+	}
+	return conn
+}
+
+func (s *Sentinel) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pool != nil {
+		s.pool.Close()
+	}
+	for _, p := range s.rpools {
+		p.Close()
+	}
+	s.rpools = make(map[string]*redis.Pool)
+	return nil
+}
+
+// 连接出错或master已降级时重新查询master, 返回master是否变化
+// 可用的sentinel放到最前面
+func (s *Sentinel) prefer(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.Addrs {
+		if s.Addrs[i] == addr {
+			s.Addrs[0], s.Addrs[i] = s.Addrs[i], s.Addrs[0]
+			return
+		}
+	}
+}
+
+func (s *Sentinel) failover(err error) bool {
+	if !needResolve(err) {
+		return false
+	}
+	s.mu.RLock()
+	old, recent := s.master, time.Since(s.resolved) < resolveInterval
+	s.mu.RUnlock()
+	if !recent && s.Resolve() != nil {
+		return false
+	}
+	return s.Master() != old || recent
+}
+
+// READONLY或网络错误需要重新查询master
+func needResolve(err error) bool {
+	if err == nil || err == redis.ErrNil {
+		return false
+	}
+	if _, ok := err.(redis.Error); ok {
+		return readOnly(err)
+	}
+	return true
+}
+
+// master已降级为replica, 命令没有执行
+func readOnly(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(e), "READONLY")
+}
+
+// sentinelConn在出错时通知Sentinel重新查询master
+type sentinelConn struct {
+	redis.Conn
+	s     *Sentinel
+	multi bool
+	watch bool
+}
+
+func (c *sentinelConn) track(cmd string) {
+	switch strings.ToUpper(cmd) {
+	case "MULTI":
+		c.multi = true
+	case "WATCH":
+		c.watch = true
+	case "EXEC", "DISCARD":
+		c.multi, c.watch = false, false
+	case "UNWATCH":
+		c.watch = false
+	}
+}
+
+func (c *sentinelConn) Send(cmd string, args ...interface{}) error {
+	c.track(cmd)
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *sentinelConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.s.failover(err)
+	return reply, err
+}
+
+func (c *sentinelConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.track(cmd)
+	reply, err := c.Conn.Do(cmd, args...)
+	if !c.s.failover(err) || !readOnly(err) || cmd == "" || c.multi || c.watch {
+		return reply, err
+	}
+
+	// master已切换, 在新的master上重试; 网络错误时命令可能已经执行, 不重试
+	c.Conn.Close()
+	c.s.mu.RLock()
+	c.Conn = c.s.pool.Get()
+	c.s.mu.RUnlock()
+	return c.Conn.Do(cmd, args...)
+}
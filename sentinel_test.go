@@ -0,0 +1,148 @@
+package orr
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type Tsentinel struct {
+	Id    int64
+	Email string `orr:"index"`
+}
+
+// 只支持SENTINEL get-master-addr-by-name及SENTINEL replicas的sentinel
+type fakeSentinel struct {
+	mu       sync.Mutex
+	ln       net.Listener
+	master   string
+	replicas []string
+}
+
+func newFakeSentinel(t *testing.T, master string, replicas ...string) *fakeSentinel {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fs := &fakeSentinel{ln: ln, master: master, replicas: replicas}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fs.serve(c)
+		}
+	}()
+	return fs
+}
+
+func (fs *fakeSentinel) setMaster(addr string) {
+	fs.mu.Lock()
+	fs.master = addr
+	fs.mu.Unlock()
+}
+
+func (fs *fakeSentinel) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		var n int
+		if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+			return
+		}
+		args := make([]string, n)
+		for i := range args {
+			var l int
+			if _, err := fmt.Fscanf(r, "$%d\r\n", &l); err != nil {
+				return
+			}
+			buf := make([]byte, l+2)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			args[i] = string(buf[:l])
+		}
+
+		fs.mu.Lock()
+		switch {
+		case len(args) == 3 && strings.ToLower(args[1]) == "get-master-addr-by-name" && args[2] == "mymaster":
+			parts := strings.Split(fs.master, ":")
+			fmt.Fprintf(c, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(parts[0]), parts[0], len(parts[1]), parts[1])
+		case len(args) == 3 && strings.ToLower(args[1]) == "replicas":
+			fmt.Fprintf(c, "*%d\r\n", len(fs.replicas))
+			for _, addr := range fs.replicas {
+				parts := strings.Split(addr, ":")
+				kv := []string{"ip", parts[0], "port", parts[1], "flags", "slave"}
+				fmt.Fprintf(c, "*%d\r\n", len(kv))
+				for _, s := range kv {
+					fmt.Fprintf(c, "$%d\r\n%s\r\n", len(s), s)
+				}
+			}
+		default:
+			fmt.Fprintf(c, "*-1\r\n")
+		}
+		fs.mu.Unlock()
+	}
+}
+
+func TestSentinel(t *testing.T) {
+	fs := newFakeSentinel(t, "127.0.0.1:6379", "localhost:6379")
+	defer fs.ln.Close()
+
+	// 第一个sentinel不可用时使用下一个
+	s, err := NewSentinel("mymaster", []string{"127.0.0.1:1", fs.ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer s.Close()
+	if s.Master() != "127.0.0.1:6379" || len(s.Replicas()) != 1 {
+		t.Fatal("unexpected master or replicas: " + s.Master())
+	}
+	if _, err = NewSentinel("unknown", []string{fs.ln.Addr().String()}); err == nil {
+		t.Fatal("unknown master should fail")
+	}
+
+	saved := rpool
+	defer func() { rpool = saved }()
+	rpool = s
+	s.ReadReplicas = true
+
+	u := &Tsentinel{Email: "s@example.com"}
+	id, err := Insert(u, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var res Tsentinel
+	if err = Select(id, "tsentinel", &res); err != nil || res.Email != u.Email {
+		t.Fatal("select from replica failed")
+	}
+	if rid, err := SelectIndex("tsentinel", "email", u.Email); err != nil || rid != id {
+		t.Fatal("select index from replica failed")
+	}
+
+	// 故障切换后, READONLY使Sentinel重新查询master
+	fs.setMaster("localhost:6379")
+	s.resolved = s.resolved.Add(-resolveInterval)
+	if !s.failover(redis.Error("READONLY You can't write against a read only replica.")) {
+		t.Fatal("READONLY should trigger failover")
+	}
+	if s.Master() != "localhost:6379" {
+		t.Fatal("master should be re-resolved, but is " + s.Master())
+	}
+	if s.failover(redis.Error("ERR wrong number of arguments")) {
+		t.Fatal("other errors should not trigger failover")
+	}
+	// 网络错误时命令可能已经执行, 只重新查询master, 不重试
+	if !needResolve(io.EOF) || readOnly(io.EOF) {
+		t.Fatal("network errors should re-resolve master without retrying")
+	}
+	if err = Delete(u); err != nil {
+		t.Fatal(err.Error())
+	}
+}
@@ -0,0 +1,749 @@
+package orr
+
+// 客户端分片
+//
+//   err := orr.OpenShards("10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379")
+//
+// Shards按类型名(包括租户)与对象id的一致性hash将对象分布到多个redis实例上.
+// 对象的所有数据都保存在同一个分片中: 主hashmap中的数据, 创建时间及过期时间,
+// 辅助索引, tags, 历史版本及KeyField, 因此对象的写操作仍然在一个事务中完成.
+// 唯一索引保存在对象所在的分片中, 唯一性检查及SelectIndex查询所有分片;
+// 并发插入相同的值到不同的分片时, 唯一性检查不能保证原子性.
+//
+// 按对象路由的操作: Insert, Update, Delete, Select, SelectIndex, SelectDeleted, Undelete,
+// InsertKeyField, SelectKeyField, DeleteKeyField, Save, Restore, History, Expire, Persist, TTL.
+// InsertMany, DeleteMany, SelectMany逐个对象执行, 不再是一个事务.
+// ReapExpired, Purge, DropTenant遍历所有分片.
+// List, ListOrdered, Count, Query, Search, Complete, Nearby, CountsBy, CountWhere*, IdsWhere*,
+// Tagged*, TagCounts查询所有分片并合并结果: 计数相加, id合并后排序, 对象从所在的分片读取;
+// 有排序及分页时每个分片读取前offset+limit个结果, 合并排序后再分页.
+// 变更流及通知写入对象所在的分片: 变更流不能与Shards一起使用, EnableChangeStream返回错误;
+// Watch及WatchType订阅所有分片.
+//
+// 增加分片:
+//   s.AddShard("10.0.0.4:6379")
+//   n, err := s.Rebalance()
+// AddShard之后新的对象即写入新的hash环; 尚未迁移的对象被访问时先迁移到新的分片,
+// Rebalance在后台迁移其余的对象, 完成后不再检查旧的分片.
+// 未注册的类型不能重建索引, 其对象留在旧的分片中并继续从旧的分片访问, Rebalance返回错误,
+// 注册类型后再次调用Rebalance.
+// Save保存的字段与KeyField相同, 随对象迁移; 回收站中的对象保留的唯一索引值也随对象迁移.
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"hash/crc32"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 每个分片在hash环上的虚拟节点数
+	shardReplicas = 160
+	// Rebalance每次HSCAN读取的对象数
+	migrateBatch = 100
+	// 迁移对象使用的锁的数量
+	migrateLocks = 64
+	// List的cursor中分片序号的位置, 低56位为分片中HSCAN的cursor
+	shardCursorShift = 56
+)
+
+// 一致性hash环
+type ring struct {
+	addrs  []string
+	hashes []uint32
+	owner  map[uint32]string
+}
+
+func newRing(addrs []string) *ring {
+	r := &ring{addrs: addrs, owner: make(map[uint32]string)}
+	for _, addr := range addrs {
+		for i := 0; i < shardReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(addr + "#" + strconv.Itoa(i)))
+			if _, ok := r.owner[h]; ok {
+				continue
+			}
+			r.owner[h] = addr
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+func (r *ring) get(key string) string {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owner[r.hashes[i]]
+}
+
+type Shards struct {
+	mu    sync.RWMutex
+	ring  *ring
+	prev  *ring // 增加分片后, 迁移完成之前的hash环
+	pools map[string]*redis.Pool
+	locks [migrateLocks]sync.Mutex // 按对象加锁, settle与Rebalance不会同时迁移同一个对象
+
+	// Dial创建到分片的连接, 默认为redis.Dial("tcp", addr)
+	Dial func(addr string) (redis.Conn, error)
+}
+
+// NewShards使用addrs作为分片, 分片的顺序不影响对象的分布
+func NewShards(addrs ...string) (*Shards, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("at least one shard address is required.")
+	}
+	s := &Shards{
+		ring:  newRing(append([]string{}, addrs...)),
+		pools: make(map[string]*redis.Pool),
+		Dial: func(addr string) (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+	for _, addr := range addrs {
+		conn := s.pool(addr).Get()
+		_, err := conn.Do("PING")
+		conn.Close()
+		if err != nil {
+			return nil, fmt.Errorf("shard %s is unavailable: %v", addr, err)
+		}
+	}
+	return s, nil
+}
+
+// OpenShards连接所有分片
+func OpenShards(addrs ...string) error {
+	if changeStream.key != "" {
+		return fmt.Errorf("change stream is not supported with shards.")
+	}
+	s, err := NewShards(addrs...)
+	if err != nil {
+		return err
+	}
+	rpool = s
+	return nil
+}
+
+func (s *Shards) pool(addr string) *redis.Pool {
+	s.mu.RLock()
+	p, ok := s.pools[addr]
+	s.mu.RUnlock()
+	if ok {
+		return p
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok = s.pools[addr]; ok {
+		return p
+	}
+	p = &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 600 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return s.Dial(addr)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+	s.pools[addr] = p
+	return p
+}
+
+func shardKey(name string, id int64) string {
+	return name + ":" + strconv.FormatInt(id, 10)
+}
+
+// Shard返回类型name中id对象所在的分片
+func (s *Shards) Shard(name string, id int64) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ring.get(shardKey(name, id))
+}
+
+// Addrs返回所有分片的地址
+func (s *Shards) Addrs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string{}, s.ring.addrs...)
+}
+
+// Get返回第一个分片的连接, 用于不按对象路由的操作
+func (s *Shards) Get() redis.Conn {
+	return s.pool(s.Addrs()[0]).Get()
+}
+
+func (s *Shards) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.pools {
+		p.Close()
+	}
+	s.pools = make(map[string]*redis.Pool)
+	return nil
+}
+
+// AddShard增加分片, 之后需要调用Rebalance迁移对象
+func (s *Shards) AddShard(addr string) error {
+	conn := s.pool(addr).Get()
+	_, err := conn.Do("PING")
+	conn.Close()
+	if err != nil {
+		return fmt.Errorf("shard %s is unavailable: %v", addr, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.ring.addrs {
+		if a == addr {
+			return fmt.Errorf("shard %s already exists.", addr)
+		}
+	}
+	if s.prev != nil {
+		return fmt.Errorf("rebalance is in progress.")
+	}
+	s.prev = s.ring
+	s.ring = newRing(append(append([]string{}, s.ring.addrs...), addr))
+	return nil
+}
+
+// Rebalance将所有不在目标分片中的对象迁移到目标分片, 返回迁移的对象数
+// 除了已注册的类型, 还从旧的分片中查找其他类型(包括租户)的对象;
+// 未注册的类型不能重建索引, 有这样的对象需要迁移时返回错误, 注册类型后再次调用Rebalance
+func (s *Shards) Rebalance() (int, error) {
+	s.mu.RLock()
+	prev := s.prev
+	s.mu.RUnlock()
+	if prev == nil {
+		return 0, nil
+	}
+
+	names := make(map[string]bool)
+	for _, m := range allModels() {
+		names[m.name] = true
+		tenants.Range(func(tenant, _ interface{}) bool {
+			names[scopedName(tenant.(string), m.name)] = true
+			return true
+		})
+	}
+	for _, addr := range prev.addrs {
+		conn := s.pool(addr).Get()
+		found, err := typeNames(conn)
+		conn.Close()
+		if err != nil {
+			return 0, err
+		}
+		for _, name := range found {
+			names[name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	n := 0
+	var unregistered []string
+	for _, name := range sorted {
+		m, _ := modelByName(name)
+		left := 0
+		for _, addr := range prev.addrs {
+			keys := []string{hashKey(name), trashKey(name)}
+			if m != nil && m.soft == nil {
+				keys = keys[:1]
+			}
+			for _, key := range keys {
+				moved, err := s.rebalance(name, m, addr, key)
+				if err != nil {
+					return n, err
+				}
+				if m != nil {
+					n += moved
+				} else {
+					left += moved
+				}
+			}
+		}
+		if left > 0 {
+			unregistered = append(unregistered, name)
+		}
+	}
+	if len(unregistered) > 0 {
+		return n, fmt.Errorf("objects of unregistered types %s are not migrated, register the types and call Rebalance again.",
+			strings.Join(unregistered, ", "))
+	}
+
+	s.mu.Lock()
+	if s.prev == prev {
+		s.prev = nil
+	}
+	s.mu.Unlock()
+	return n, nil
+}
+
+// 分片中有对象的类型名, 从每个类型的创建时间zset及回收站hashmap的key中得到
+// KeyNamer生成的key不包含类型名时返回nil
+func typeNames(conn redis.Conn) ([]string, error) {
+	names := make(map[string]bool)
+	for _, suffix := range []string{":created", ":trash"} {
+		k := redisKey("\x00", suffix)
+		i := strings.Index(k, "\x00")
+		if i < 0 {
+			return nil, nil
+		}
+		prefix, post := k[:i], k[i+1:]
+		cursor := "0"
+		for {
+			reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*"+post, "COUNT", migrateBatch))
+			if err != nil {
+				return nil, err
+			}
+			if cursor, err = redis.String(reply[0], nil); err != nil {
+				return nil, err
+			}
+			keys, err := redis.Strings(reply[1], nil)
+			if err != nil {
+				return nil, err
+			}
+			for _, key := range keys {
+				if len(key) > len(prefix)+len(post) && strings.HasPrefix(key, prefix) && strings.HasSuffix(key, post) {
+					names[key[len(prefix):len(key)-len(post)]] = true
+				}
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+	}
+	var res []string
+	for name := range names {
+		res = append(res, name)
+	}
+	return res, nil
+}
+
+// 迁移分片addr中hashmap key的对象; m为nil(类型未注册)时只返回需要迁移的对象数
+func (s *Shards) rebalance(name string, m *model, addr string, key string) (int, error) {
+	conn := s.pool(addr).Get()
+	defer conn.Close()
+
+	if m == nil {
+		// 从key中得到的类型名可能不是对象的hashmap
+		if typ, err := redis.String(conn.Do("TYPE", key)); err != nil || typ != "hash" {
+			return 0, err
+		}
+	}
+	n := 0
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("HSCAN", key, cursor, "COUNT", migrateBatch))
+		if err != nil {
+			return n, err
+		}
+		if cursor, err = redis.String(reply[0], nil); err != nil {
+			return n, err
+		}
+		items, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return n, err
+		}
+		for i := 0; i+1 < len(items); i += 2 {
+			id, err := strconv.ParseInt(items[i], 10, 64)
+			if err != nil {
+				continue
+			}
+			if to := s.Shard(name, id); to != addr {
+				if m != nil {
+					if err = s.migrate(m, items[i], addr, to); err != nil {
+						return n, err
+					}
+				}
+				n++
+			}
+		}
+		if cursor == "0" {
+			return n, nil
+		}
+	}
+}
+
+// 迁移期间访问对象之前, 将对象从旧的分片迁移到目标分片, 返回对象所在的分片
+// 类型未注册时不能重建索引, 对象仍在旧的分片中时访问旧的分片, 注册类型后由Rebalance迁移
+func (s *Shards) settle(name string, id int64) (string, error) {
+	s.mu.RLock()
+	prev := s.prev
+	to := s.ring.get(shardKey(name, id))
+	s.mu.RUnlock()
+	if prev == nil {
+		return to, nil
+	}
+	from := prev.get(shardKey(name, id))
+	if from == to {
+		return to, nil
+	}
+	sid := strconv.FormatInt(id, 10)
+	m, ok := modelByName(name)
+	if ok {
+		return to, s.migrate(m, sid, from, to)
+	}
+
+	conn := s.pool(from).Get()
+	defer conn.Close()
+	conn.Send("HEXISTS", hashKey(name), sid)
+	conn.Send("HEXISTS", trashKey(name), sid)
+	found, err := redis.Ints(conn.Do(""))
+	if err != nil {
+		return "", err
+	}
+	if found[0] == 1 || found[1] == 1 {
+		return from, nil
+	}
+	return to, nil
+}
+
+// 将对象sid的所有数据从分片from迁移到分片to
+// 同一进程中按对象加锁; 其他进程同时写入目标分片时, WATCH使写入失败后重试
+func (s *Shards) migrate(m *model, sid string, from, to string) error {
+	mu := &s.locks[crc32.ChecksumIEEE([]byte(m.name+":"+sid))%migrateLocks]
+	mu.Lock()
+	defer mu.Unlock()
+
+	src := s.pool(from).Get()
+	defer src.Close()
+	dst := s.pool(to).Get()
+	defer dst.Close()
+	for retry := 0; ; retry++ {
+		err := s.move(m, sid, src, dst)
+		if err != errWatch || retry >= maxWatchRetry {
+			return err
+		}
+	}
+}
+
+// 目标分片中已有该对象时(迁移开始后被重新写入), 只删除旧分片中的数据
+func (s *Shards) move(m *model, sid string, src, dst redis.Conn) error {
+	if _, err := dst.Do("WATCH", hashKey(m.name), trashKey(m.name)); err != nil {
+		return err
+	}
+	defer dst.Do("UNWATCH")
+	dst.Send("HEXISTS", hashKey(m.name), sid)
+	dst.Send("HEXISTS", trashKey(m.name), sid)
+	found, err := redis.Ints(dst.Do(""))
+	if err != nil {
+		return err
+	}
+	exists := found[0] == 1 || found[1] == 1
+
+	src.Send("HGET", hashKey(m.name), sid)
+	src.Send("HGET", trashKey(m.name), sid)
+	src.Send("ZSCORE", createdKey(m.name), sid)
+	src.Send("ZSCORE", expireKey(m.name), sid)
+	src.Send("ZSCORE", trashedKey(m.name), sid)
+	src.Send("LRANGE", historyKey(m.name, sid), 0, -1)
+	src.Send("SMEMBERS", keyFieldsKey(m.name))
+	r, err := redis.Values(src.Do(""))
+	if err != nil || (r[0] == nil && r[1] == nil) {
+		return err
+	}
+
+	// KeyField的值
+	kfs, _ := redis.Strings(r[6], nil)
+	for _, kf := range kfs {
+		parts := strings.SplitN(kf, ":", 2)
+		if len(parts) == 2 && parts[0] == "key" {
+			src.Send("GET", keyFieldKey(m.name, parts[1], sid))
+		} else if len(parts) == 2 {
+			src.Send("HGET", keyFieldHashKey(m.name, parts[1]), sid)
+		}
+	}
+	var values []interface{}
+	if len(kfs) > 0 {
+		if values, err = redis.Values(src.Do("")); err != nil {
+			return err
+		}
+	}
+
+	var obj, trashed reflect.Value
+	if r[0] != nil {
+		if obj, _, err = m.decode(r[0].([]byte)); err != nil {
+			return err
+		}
+	}
+	// 回收站中的对象保留的唯一索引值随对象迁移
+	reserved := r[1] != nil && m.softReserve
+	if reserved {
+		if trashed, _, err = m.decode(r[1].([]byte)); err != nil {
+			return err
+		}
+	}
+
+	if !exists {
+		t := &tx{}
+		if r[0] != nil {
+			t.add("HSET", hashKey(m.name), sid, r[0])
+			if err = m.addIndexes(t, sid, obj); err != nil {
+				return err
+			}
+		}
+		if r[1] != nil {
+			t.add("HSET", trashKey(m.name), sid, r[1])
+		}
+		if reserved {
+			if err = m.reserveIndexes(t, sid, trashed); err != nil {
+				return err
+			}
+		}
+		for i, key := range []string{createdKey(m.name), expireKey(m.name), trashedKey(m.name)} {
+			if r[2+i] != nil {
+				t.add("ZADD", key, r[2+i], sid)
+			}
+		}
+		if items, _ := redis.Values(r[5], nil); len(items) > 0 {
+			t.add("DEL", historyKey(m.name, sid))
+			t.add("RPUSH", append([]interface{}{historyKey(m.name, sid)}, items...)...)
+		}
+		for i, kf := range kfs {
+			if i >= len(values) || values[i] == nil {
+				continue
+			}
+			parts := strings.SplitN(kf, ":", 2)
+			if parts[0] == "key" {
+				t.add("SET", keyFieldKey(m.name, parts[1], sid), values[i])
+			} else {
+				t.add("HSET", keyFieldHashKey(m.name, parts[1]), sid, values[i])
+			}
+			t.add("SADD", keyFieldsKey(m.name), kf)
+		}
+		if _, err = t.exec(dst); err != nil {
+			return err
+		}
+	}
+
+	t := &tx{}
+	if r[0] != nil {
+		m.purgeCommands(t, sid, obj)
+	}
+	if reserved {
+		m.releaseIndexes(t, trashed)
+	}
+	t.add("HDEL", trashKey(m.name), sid)
+	t.add("ZREM", trashedKey(m.name), sid)
+	t.add("DEL", historyKey(m.name, sid))
+	for _, kf := range kfs {
+		parts := strings.SplitN(kf, ":", 2)
+		if len(parts) == 2 && parts[0] == "key" {
+			t.add("DEL", keyFieldKey(m.name, parts[1], sid))
+		} else if len(parts) == 2 {
+			t.add("HDEL", keyFieldHashKey(m.name, parts[1]), sid)
+		}
+	}
+	_, err = t.exec(src)
+	return err
+}
+
+// 对象id所在的连接, 使用Shards时按类型和id选择分片
+func objConn(name string, id int64) (redis.Conn, error) {
+	s, ok := rpool.(*Shards)
+	if !ok {
+		return rpool.Get(), nil
+	}
+	addr, err := s.settle(name, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.pool(addr).Get(), nil
+}
+
+// 读取对象id使用的连接, 不使用Shards时可以从replica读取
+func objReadConn(name string, id int64) (redis.Conn, error) {
+	if _, ok := rpool.(*Shards); ok {
+		return objConn(name, id)
+	}
+	return readConn(), nil
+}
+
+// 所有分片的连接, 用于需要遍历所有对象的操作; 不使用Shards时只有一个连接
+func allConns() []redis.Conn {
+	s, ok := rpool.(*Shards)
+	if !ok {
+		return []redis.Conn{rpool.Get()}
+	}
+	// 增加分片时旧的分片仍在hash环中, 因此迁移期间也包含所有数据
+	var conns []redis.Conn
+	for _, addr := range s.Addrs() {
+		conns = append(conns, s.pool(addr).Get())
+	}
+	return conns
+}
+
+func closeConns(conns []redis.Conn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// 是否使用客户端分片
+func sharded() bool {
+	_, ok := rpool.(*Shards)
+	return ok
+}
+
+// 分片查询的结果
+type hit struct {
+	id    interface{} // redis返回的对象id
+	score float64     // 合并各分片的结果时排序使用
+	shard int         // 对象所在的分片在allConns中的序号
+}
+
+func (h hit) intId() int64 {
+	id, _ := redis.Int64(h.id, nil)
+	return id
+}
+
+// 有分页的查询, 多个分片时每个分片返回前offset+limit个结果, 由mergeHits合并后分页
+func shardWindow(shards, offset, limit int) (int, int) {
+	if shards == 1 {
+		return offset, limit
+	}
+	if limit <= 0 {
+		return 0, 0
+	}
+	return 0, offset + limit
+}
+
+// 合并各分片的结果: 只有一个分片时结果已分页, 直接返回;
+// 否则按score排序(score相同时按id), 返回第offset个开始的limit个, limit为0时不限制
+func mergeHits(lists [][]hit, desc bool, offset, limit int) []hit {
+	if len(lists) == 1 {
+		return lists[0]
+	}
+	var hits []hit
+	for _, l := range lists {
+		hits = append(hits, l...)
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return (hits[i].score < hits[j].score) != desc
+		}
+		return (hits[i].intId() < hits[j].intId()) != desc
+	})
+	if offset >= len(hits) {
+		return nil
+	}
+	hits = hits[offset:]
+	if limit > 0 && limit < len(hits) {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+// 以id作为score, 按id升序合并
+func idHits(ids []interface{}, shard int) []hit {
+	hits := make([]hit, len(ids))
+	for i, id := range ids {
+		hits[i] = hit{id: id, shard: shard}
+		hits[i].score = float64(hits[i].intId())
+	}
+	return hits
+}
+
+// 解析WITHSCORES的返回: [member, score, ...]
+func scoredHits(items []interface{}, shard int) ([]hit, error) {
+	hits := make([]hit, 0, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		score, err := redis.Float64(items[i+1], nil)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, hit{id: items[i], score: score, shard: shard})
+	}
+	return hits, nil
+}
+
+func hitIds(hits []hit) []int64 {
+	if len(hits) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(hits))
+	for i, h := range hits {
+		ids[i] = h.intId()
+	}
+	return ids
+}
+
+// 从对象所在的分片读取hits对应的对象, 与hits一一对应; 已不存在或已过期的对象为nil
+func hmgetHits(conns []redis.Conn, name string, hits []hit) ([]interface{}, error) {
+	ids := make([][]interface{}, len(conns))
+	pos := make([][]int, len(conns))
+	for i, h := range hits {
+		ids[h.shard] = append(ids[h.shard], h.id)
+		pos[h.shard] = append(pos[h.shard], i)
+	}
+	replies := make([]interface{}, len(hits))
+	for shard, conn := range conns {
+		if len(ids[shard]) == 0 {
+			continue
+		}
+		r, err := hmgetLive(conn, name, ids[shard])
+		if err != nil {
+			return nil, err
+		}
+		for i, reply := range r {
+			replies[pos[shard][i]] = reply
+		}
+	}
+	return replies, nil
+}
+
+// 合并各分片按升序排列的id
+func mergeIds(lists [][]int64) []int64 {
+	if len(lists) == 1 {
+		return lists[0]
+	}
+	var ids []int64
+	for _, l := range lists {
+		ids = append(ids, l...)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// 在每个分片中计数, 返回总数
+func sumShards(count func(conn redis.Conn) (int64, error)) (int64, error) {
+	conns := allConns()
+	defer closeConns(conns)
+	var total int64
+	for _, conn := range conns {
+		n, err := count(conn)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// 在每个分片中查询按升序排列的id, 返回合并后的结果
+func mergeShards(ids func(conn redis.Conn) ([]int64, error)) ([]int64, error) {
+	conns := allConns()
+	defer closeConns(conns)
+	lists := make([][]int64, len(conns))
+	for i, conn := range conns {
+		l, err := ids(conn)
+		if err != nil {
+			return nil, err
+		}
+		lists[i] = l
+	}
+	return mergeIds(lists), nil
+}
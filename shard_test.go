@@ -0,0 +1,559 @@
+package orr
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Tshard struct {
+	Id    int64
+	Name  string
+	Email string `orr:"index"`
+}
+
+type Tshardsoft struct {
+	Id        int64
+	Email     string `orr:"index"`
+	Notes     []string
+	DeletedAt int64 `orr:"softdelete=reserve"`
+}
+
+type Tshardquery struct {
+	Id     int64
+	Name   string   `orr:"text;prefix"`
+	Group  string   `orr:"set;count"`
+	Score  int      `orr:"range"`
+	Labels []string `orr:"tags"`
+	Active bool     `orr:"bitmap"`
+	Loc    GeoPoint `orr:"geo"`
+}
+
+// 只在TestShardsRebalanceUnregistered中使用, 测试开始时未注册
+type Tshardother struct {
+	Id   int64
+	Name string
+}
+
+// 使用同一个redis的不同数据库作为分片, 地址为db11, db12...
+func testShards(t *testing.T, addrs ...string) *Shards {
+	s := &Shards{
+		ring:  newRing(addrs),
+		pools: make(map[string]*redis.Pool),
+	}
+	s.Dial = func(addr string) (redis.Conn, error) {
+		db, _ := strconv.Atoi(strings.TrimPrefix(addr, "db"))
+		return redis.Dial("tcp", "127.0.0.1:6379", redis.DialDatabase(db))
+	}
+	for _, addr := range []string{"db11", "db12", "db13", "db14"} {
+		conn := s.pool(addr).Get()
+		if _, err := conn.Do("FLUSHDB"); err != nil {
+			t.Fatal(err.Error())
+		}
+		conn.Close()
+	}
+	return s
+}
+
+// 每个分片中类型name的对象数
+func shardCounts(t *testing.T, s *Shards, name string) map[string]int {
+	counts := make(map[string]int)
+	for _, addr := range s.Addrs() {
+		conn := s.pool(addr).Get()
+		n, err := redis.Int(conn.Do("HLEN", hashKey(name)))
+		conn.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		counts[addr] = n
+	}
+	return counts
+}
+
+func TestShards(t *testing.T) {
+	s := testShards(t, "db11", "db12", "db13")
+	saved := rpool
+	defer func() {
+		rpool = saved
+		s.Close()
+	}()
+	rpool = s
+
+	var ids []int64
+	for i := 0; i < 30; i++ {
+		u := &Tshard{Name: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("u%d@example.com", i)}
+		id, err := Insert(u, true)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ids = append(ids, id)
+		if err = InsertKeyField("hash", "tshard", "bio", id, "bio of "+u.Name); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	counts := shardCounts(t, s, "tshard")
+	for addr, n := range counts {
+		if n == 0 {
+			t.Fatal("no object is stored in shard " + addr)
+		}
+	}
+
+	if _, err := Insert(&Tshard{Email: "u7@example.com"}, true); err == nil {
+		t.Fatal("unique index should be checked in all shards")
+	}
+	if id, err := SelectIndex("tshard", "email", "u7@example.com"); err != nil || id != ids[7] {
+		t.Fatal("select index should search all shards")
+	}
+	var res []Tshard
+	errs, err := SelectMany(ids, "tshard", &res)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := range ids {
+		if errs[i] != nil || res[i].Name != fmt.Sprintf("user%d", i) {
+			t.Fatal(fmt.Sprintf("select many from shards failed at %d", i))
+		}
+	}
+
+	// 增加分片, 被访问的对象先迁移
+	if err = s.AddShard("db14"); err != nil {
+		t.Fatal(err.Error())
+	}
+	var touched int64 = -1
+	for _, id := range ids {
+		if s.Shard("tshard", id) == "db14" {
+			touched = id
+			break
+		}
+	}
+	if touched == -1 {
+		t.Fatal("no object should be moved to the new shard")
+	}
+	var u Tshard
+	if err = Select(touched, "tshard", &u); err != nil || u.Id != touched {
+		t.Fatal("object should be readable during rebalance")
+	}
+	if shardCounts(t, s, "tshard")["db14"] != 1 {
+		t.Fatal("touched object should be migrated to the new shard")
+	}
+
+	n, err := s.Rebalance()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	counts = shardCounts(t, s, "tshard")
+	if counts["db14"] != n+1 {
+		t.Fatal(fmt.Sprintf("rebalance moved %d objects, but new shard has %d", n, counts["db14"]))
+	}
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+	if total != len(ids) {
+		t.Fatal(fmt.Sprintf("expect %d objects after rebalance, got %d", len(ids), total))
+	}
+
+	for i, id := range ids {
+		var bio string
+		if err = SelectKeyField("hash", "tshard", "bio", id, &bio); err != nil || bio != fmt.Sprintf("bio of user%d", i) {
+			t.Fatal("key field should be migrated with the object")
+		}
+		if rid, err := SelectIndex("tshard", "email", fmt.Sprintf("u%d@example.com", i)); err != nil || rid != id {
+			t.Fatal("index should be migrated with the object")
+		}
+	}
+	if _, err = Insert(&Tshard{Email: "u3@example.com"}, true); err == nil {
+		t.Fatal("unique index should be checked after rebalance")
+	}
+
+	errs = DeleteMany([]interface{}{Tshard{Id: ids[0]}, Tshard{Id: ids[1]}})
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatal("delete many from shards failed")
+	}
+	if err = Select(ids[0], "tshard", &u); err != ErrNotFound {
+		t.Fatal("deleted object should not be found")
+	}
+}
+
+func TestRing(t *testing.T) {
+	r := newRing([]string{"a", "b", "c"})
+	r2 := newRing([]string{"a", "b", "c", "d"})
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		k := shardKey("tshard", int64(i))
+		if r.get(k) != r2.get(k) {
+			if r2.get(k) != "d" {
+				t.Fatal("keys should only move to the new shard")
+			}
+			moved++
+		}
+	}
+	if moved < 100 || moved > 400 {
+		t.Fatal(fmt.Sprintf("about a quarter of keys should move, but %d moved", moved))
+	}
+}
+
+func TestShardsConcurrentMigrate(t *testing.T) {
+	s := testShards(t, "db11", "db12")
+	saved := rpool
+	defer func() {
+		rpool = saved
+		s.Close()
+	}()
+	rpool = s
+
+	var ids []int64
+	for i := 0; i < 50; i++ {
+		id, err := Insert(&Tshard{Name: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("c%d@example.com", i)}, true)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ids = append(ids, id)
+	}
+	if err := s.AddShard("db13"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// 访问对象与Rebalance同时迁移同一个对象, 对象只保留一份
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, id := range ids {
+				var u Tshard
+				Select(id, "tshard", &u)
+			}
+		}()
+	}
+	if _, err := s.Rebalance(); err != nil {
+		t.Fatal(err.Error())
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range shardCounts(t, s, "tshard") {
+		total += n
+	}
+	if total != len(ids) {
+		t.Fatal(fmt.Sprintf("expect %d objects after concurrent migration, got %d", len(ids), total))
+	}
+	for i, id := range ids {
+		var u Tshard
+		if err := Select(id, "tshard", &u); err != nil || u.Name != fmt.Sprintf("user%d", i) {
+			t.Fatal("object should be readable after concurrent migration")
+		}
+	}
+}
+
+func TestShardsMigrateSaved(t *testing.T) {
+	s := testShards(t, "db11", "db12")
+	saved := rpool
+	defer func() {
+		rpool = saved
+		s.Close()
+	}()
+	rpool = s
+	Register(Tshardsoft{})
+
+	var objs []*Tshardsoft
+	for i := 0; i < 20; i++ {
+		u := &Tshardsoft{Email: fmt.Sprintf("s%d@example.com", i), Notes: []string{fmt.Sprintf("note%d", i)}}
+		if _, err := Insert(u, true); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := Save(u, "Notes"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if i%2 == 1 {
+			if err := Delete(u); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		objs = append(objs, u)
+	}
+	if err := s.AddShard("db13"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := s.Rebalance(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i, u := range objs {
+		if i%2 == 0 {
+			v := &Tshardsoft{Id: u.Id}
+			if err := Restore(v, "Notes"); err != nil || len(v.Notes) != 1 || v.Notes[0] != u.Notes[0] {
+				t.Fatal("saved field should be migrated with the object")
+			}
+			continue
+		}
+		// 保留的唯一索引值只在对象所在的分片中
+		for _, addr := range s.Addrs() {
+			conn := s.pool(addr).Get()
+			id, _ := redis.Int64(conn.Do("HGET", reservedKey("tshardsoft", "email"), u.Email))
+			conn.Close()
+			if owner := addr == s.Shard("tshardsoft", u.Id); owner != (id == u.Id) {
+				t.Fatal("reserved index should be migrated with the trashed object")
+			}
+		}
+	}
+	if _, err := Insert(&Tshardsoft{Email: objs[1].Email}, true); err == nil {
+		t.Fatal("reserved index should be checked after rebalance")
+	}
+	if _, err := Purge("tshardsoft", 0); err != nil {
+		t.Fatal(err.Error())
+	}
+	u := &Tshardsoft{Email: objs[1].Email}
+	if _, err := Insert(u, true); err != nil {
+		t.Fatal("purge should release the migrated reserved index")
+	}
+}
+
+func TestShardsQuery(t *testing.T) {
+	s := testShards(t, "db11", "db12", "db13")
+	saved := rpool
+	defer func() {
+		rpool = saved
+		s.Close()
+	}()
+	rpool = s
+
+	var ids []int64
+	for i := 0; i < 30; i++ {
+		u := &Tshardquery{
+			Name:   fmt.Sprintf("item%02d", i),
+			Group:  fmt.Sprintf("g%d", i%3),
+			Score:  i,
+			Labels: []string{[]string{"even", "odd"}[i%2]},
+			Active: i%5 == 0,
+			Loc:    GeoPoint{Lat: 30 + float64(i)*0.0001, Lng: 120},
+		}
+		id, err := Insert(u, true)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ids = append(ids, id)
+	}
+	used := 0
+	for _, n := range shardCounts(t, s, "tshardquery") {
+		if n > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Fatal("objects should be stored in several shards")
+	}
+
+	if n, err := Count("tshardquery"); err != nil || n != 30 {
+		t.Fatal("Count should sum all shards")
+	}
+
+	seen := make(map[int64]bool)
+	var cursor uint64
+	for {
+		var page []Tshardquery
+		next, err := List("tshardquery", cursor, 10, &page)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, u := range page {
+			seen[u.Id] = true
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	if len(seen) != 30 {
+		t.Fatal(fmt.Sprintf("List should visit all shards, got %d objects", len(seen)))
+	}
+
+	var ordered []Tshardquery
+	cursor = 0
+	for {
+		next, err := ListOrdered("tshardquery", cursor, 7, &ordered)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	if len(ordered) != 30 {
+		t.Fatal(fmt.Sprintf("ListOrdered should return all objects, got %d", len(ordered)))
+	}
+	for i, u := range ordered {
+		if u.Id != ids[i] {
+			t.Fatal("ListOrdered should merge shards by creation time")
+		}
+	}
+
+	var res []Tshardquery
+	err := NewQuery(Tshardquery{}).Where("Score", ">=", 10).OrderBy("Score").Offset(5).Limit(10).Find(&res)
+	if err != nil || len(res) != 10 || res[0].Score != 15 || res[9].Score != 24 {
+		t.Fatal("Query should merge and page results of all shards")
+	}
+	res = nil
+	err = NewQuery(Tshardquery{}).OrderByDesc("Score").Limit(3).Find(&res)
+	if err != nil || len(res) != 3 || res[0].Score != 29 || res[2].Score != 27 {
+		t.Fatal("Query should merge descending results of all shards")
+	}
+	got, err := NewQuery(Tshardquery{}).Where("Group", "=", "g1").Ids()
+	if err != nil || len(got) != 10 || got[0] != ids[1] || got[9] != ids[28] {
+		t.Fatal("Query.Ids should return ids of all shards in order")
+	}
+
+	if got, err = SearchIds("tshardquery", "item*", 5); err != nil || len(got) != 5 || got[4] != ids[4] {
+		t.Fatal("SearchIds should merge shards by id")
+	}
+	res = nil
+	if err = Search("tshardquery", "item1*", 0, &res); err != nil || len(res) != 10 {
+		t.Fatal("Search should return objects of all shards")
+	}
+	cs, err := Complete("tshardquery", "name", "item1", 3)
+	if err != nil || len(cs) != 3 || cs[0].Value != "item10" || cs[2].Value != "item12" {
+		t.Fatal("Complete should merge shards by value")
+	}
+
+	res = nil
+	dists, err := Nearby("tshardquery", 30, 120, 1000, 5, &res)
+	if err != nil || len(res) != 5 || len(dists) != 5 {
+		t.Fatal("Nearby should return the nearest objects of all shards")
+	}
+	for i, u := range res {
+		if u.Id != ids[i] || (i > 0 && dists[i] < dists[i-1]) {
+			t.Fatal("Nearby should merge shards by distance")
+		}
+	}
+
+	counts, err := CountsBy("tshardquery", "group")
+	if err != nil || counts["g0"] != 10 || counts["g1"] != 10 || counts["g2"] != 10 {
+		t.Fatal("CountsBy should sum all shards")
+	}
+	if n, err := CountWhere("tshardquery", "active"); err != nil || n != 6 {
+		t.Fatal("CountWhere should sum all shards")
+	}
+	if got, err = IdsWhere("tshardquery", "active"); err != nil || len(got) != 6 || got[1] != ids[5] {
+		t.Fatal("IdsWhere should merge all shards")
+	}
+	if got, err = TaggedAny("tshardquery", "labels", "even"); err != nil || len(got) != 15 || got[0] != ids[0] {
+		t.Fatal("TaggedAny should merge all shards")
+	}
+	tags, err := TagCounts("tshardquery", "labels", "even", "odd")
+	if err != nil || tags["even"] != 15 || tags["odd"] != 15 {
+		t.Fatal("TagCounts should sum all shards")
+	}
+}
+
+func TestShardsRebalanceUnregistered(t *testing.T) {
+	s := testShards(t, "db11", "db12")
+	saved := rpool
+	defer func() {
+		rpool = saved
+		s.Close()
+	}()
+	rpool = s
+
+	// 其他进程写入的对象, 本进程没有注册该类型
+	var ids []int64
+	for i := int64(1); i <= 20; i++ {
+		buf, err := encodeValue(defaultCodec(), &Tshardother{Id: i, Name: fmt.Sprintf("other%d", i)})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		conn := s.pool(s.Shard("tshardother", i)).Get()
+		conn.Send("HSET", hashKey("tshardother"), i, buf)
+		conn.Send("ZADD", createdKey("tshardother"), i, i)
+		_, err = conn.Do("")
+		conn.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ids = append(ids, i)
+	}
+	if _, ok := modelByName("tshardother"); ok {
+		t.Fatal("type tshardother should not be registered yet")
+	}
+
+	if err := s.AddShard("db13"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := s.Rebalance(); err == nil || !strings.Contains(err.Error(), "tshardother") {
+		t.Fatal("rebalance should fail while objects of unregistered types are not migrated")
+	}
+	if s.prev == nil {
+		t.Fatal("old shards should be kept until all objects are migrated")
+	}
+	// 未迁移的对象仍然可以访问
+	for _, id := range ids {
+		var res map[string]interface{}
+		if err := Select(id, "tshardother", &res); err != nil || res["Name"] != fmt.Sprintf("other%d", id) {
+			t.Fatal("object of unregistered type should be readable before it is migrated")
+		}
+	}
+
+	Register(Tshardother{})
+	if _, err := s.Rebalance(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s.prev != nil {
+		t.Fatal("rebalance should finish after the type is registered")
+	}
+	counts := shardCounts(t, s, "tshardother")
+	if counts["db13"] == 0 || counts["db11"]+counts["db12"]+counts["db13"] != len(ids) {
+		t.Fatal(fmt.Sprintf("objects should be migrated after the type is registered: %v", counts))
+	}
+	for _, id := range ids {
+		var u Tshardother
+		if err := Select(id, "tshardother", &u); err != nil || u.Name != fmt.Sprintf("other%d", id) {
+			t.Fatal("object should be readable after rebalance")
+		}
+	}
+}
+
+func TestShardsWatch(t *testing.T) {
+	s := testShards(t, "db11", "db12", "db13")
+	saved := rpool
+	defer func() {
+		rpool = saved
+		s.Close()
+	}()
+	rpool = s
+
+	if n := len(watchConns()); n != 3 {
+		t.Fatal(fmt.Sprintf("watch should subscribe all 3 shards, got %d", n))
+	}
+	events, stop := WatchType("tshard")
+	ids := make(map[int64]bool)
+	for i := 0; i < 10; i++ {
+		id, err := Insert(&Tshard{Name: fmt.Sprintf("watch%d", i), Email: fmt.Sprintf("w%d@example.com", i)}, true)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ids[id] = true
+	}
+	// 测试中的分片是同一个redis的不同数据库, Pub/Sub不区分数据库, 每条通知会收到多次
+	for len(ids) > 0 {
+		select {
+		case e := <-events:
+			delete(ids, e.Id)
+		case <-time.After(time.Second):
+			t.Fatal("watch should receive events of objects in all shards")
+		}
+	}
+
+	stop()
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("channel should be closed after stop")
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package orr
+
+// 软删除
+//
+// 类型中有tag为softdelete的字段(int64或time.Time, int64为unix时间秒)时, Delete不直接删除对象,
+// 而是设置该字段为删除时间, 将对象从主hashmap移入回收站hashmap(结构名:trash),
+// 并在zset(结构名:trashed)中记录删除时间. 回收站中的对象不会被Select, List, Query等返回.
+//
+// 对象的辅助索引在软删除时被删除, Undelete时重建;
+// `orr:"softdelete=reserve"` 时保留唯一索引的值, 其他对象不能使用这些值, 直到对象被Purge;
+// 保留的值保存在单独的hashmap(结构名_字段名:reserved)中, 只用于唯一性检查, SelectIndex及Query不会查到回收站中的对象.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// 对象在回收站中, 需要先Undelete
+var ErrDeleted = errors.New("object is in trash, undelete it first.")
+
+func trashKey(name string) string {
+	return redisKey(name, ":trash")
+}
+
+func trashedKey(name string) string {
+	return redisKey(name, ":trashed")
+}
+
+// 回收站中的对象保留的唯一索引值, 只用于唯一性检查, 不被SelectIndex及Query读取
+func reservedKey(objName, fieldName string) string {
+	return redisKey(objName, fieldSuffix(fieldName)+":reserved")
+}
+
+// 设置软删除时间字段
+func (m *model) setDeletedAt(rv reflect.Value, tm time.Time) error {
+	return setTime(m.soft, rv, tm)
+}
+
+// 将对象移入回收站
+func (m *model) softDeleteCommands(t *tx, sid string, old reflect.Value) error {
+	tm := now()
+	if err := m.setDeletedAt(old, tm); err != nil {
+		return err
+	}
+	buf, err := m.encode(old.Addr().Interface())
+	if err != nil {
+		return err
+	}
+
+	m.removeIndexes(t, sid, old)
+	if m.softReserve {
+		if err = m.reserveIndexes(t, sid, old); err != nil {
+			return err
+		}
+	}
+	t.add("HDEL", hashKey(m.name), sid)
+	t.add("ZREM", createdKey(m.name), sid)
+	t.add("HSET", trashKey(m.name), sid, buf)
+	t.add("ZADD", trashedKey(m.name), tm.Unix(), sid)
+	return nil
+}
+
+// 回收站中的对象保留唯一索引的值
+func (m *model) reserveIndexes(t *tx, sid string, rv reflect.Value) error {
+	for _, f := range m.fields {
+		if fv := rv.Field(f.index); f.has("index") && fv.String() != "" {
+			v, err := m.indexValue(f, fv.String())
+			if err != nil {
+				return err
+			}
+			t.add("HSET", reservedKey(m.name, f.name), v, sid)
+		}
+	}
+	return nil
+}
+
+// 释放回收站中的对象保留的唯一索引值
+func (m *model) releaseIndexes(t *tx, rv reflect.Value) {
+	for _, f := range m.fields {
+		if v := rv.Field(f.index); f.has("index") && v.String() != "" {
+			if iv, err := m.indexValue(f, v.String()); err == nil {
+				t.add("HDEL", reservedKey(m.name, f.name), iv)
+			}
+		}
+	}
+}
+
+// SelectDeleted读取回收站中的对象
+func SelectDeleted(Id int64, name string, res interface{}) error {
+	if reflect.TypeOf(res).Kind() != reflect.Ptr {
+		return fmt.Errorf("param res must be Ptr type.")
+	}
+	conn, err := objReadConn(name, Id)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	reply, err := conn.Do("HGET", trashKey(name), Id)
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return ErrNotFound
+	}
+	return decodeObject(reply.([]byte), res)
+}
+
+// Undelete将回收站中的对象恢复, 并重建辅助索引
+// 未保留唯一索引时, 若其值已被其他对象使用, 返回错误
+func Undelete(name string, id int64) error {
+	m, ok := modelByName(name)
+	if !ok || m.soft == nil {
+		return fmt.Errorf("type %s is not registered or does not support softdelete.", name)
+	}
+	sid := strconv.FormatInt(id, 10)
+
+	conn, err := objConn(m.name, id)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for retry := 0; ; retry++ {
+		if _, err := conn.Do("WATCH", hashKey(m.name), trashKey(m.name)); err != nil {
+			return err
+		}
+		obj, ok, err := m.load(conn, trashKey(m.name), sid)
+		if err != nil || !ok {
+			conn.Do("UNWATCH")
+			if err == nil {
+				err = ErrNotFound
+			}
+			return err
+		}
+
+		if !m.softReserve {
+			for _, f := range m.fields {
+				v := obj.Field(f.index)
+				if !f.has("index") || v.String() == "" {
+					continue
+				}
+				iv, err := m.indexValue(f, v.String())
+				if err == nil && !unique(indexKey(m.name, f.name), iv) {
+					err = fmt.Errorf("field %s has exist value %s.", f.name, v.String())
+				}
+				if err != nil {
+					conn.Do("UNWATCH")
+					return err
+				}
+			}
+		}
+
+		if err = m.setDeletedAt(obj, time.Time{}); err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		buf, err := m.encode(obj.Addr().Interface())
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		t := &tx{}
+		if err = m.historyCommands(context.Background(), t, "undelete", sid, reflect.Value{}); err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		changeCommand(t, m.name, sid, "undelete", m.changedFields(reflect.Value{}, obj), buf)
+		t.add("HDEL", trashKey(m.name), sid)
+		t.add("ZREM", trashedKey(m.name), sid)
+		t.add("HSET", hashKey(m.name), sid, buf)
+		t.add("ZADD", createdKey(m.name), createdScore(), sid)
+		if m.softReserve {
+			m.releaseIndexes(t, obj)
+		}
+		if err = m.addIndexes(t, sid, obj); err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		_, err = t.exec(conn)
+		if err != errWatch || retry >= maxWatchRetry {
+			return err
+		}
+	}
+}
+
+// Purge彻底删除回收站中删除时间早于olderThan之前的对象, 返回删除的对象数
+// 保留的唯一索引值在此时释放
+func Purge(name string, olderThan time.Duration) (int, error) {
+	m, ok := modelByName(name)
+	if !ok || m.soft == nil {
+		return 0, fmt.Errorf("type %s is not registered or does not support softdelete.", name)
+	}
+
+	conns := allConns()
+	defer closeConns(conns)
+	n := 0
+	for _, conn := range conns {
+		purged, err := m.purge(conn, olderThan)
+		n += purged
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// 彻底删除conn所在的节点中回收站内删除时间早于olderThan之前的对象
+func (m *model) purge(conn redis.Conn, olderThan time.Duration) (int, error) {
+	sids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", trashedKey(m.name),
+		"-inf", now().Add(-olderThan).Unix()))
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, sid := range sids {
+		ok, err := m.purgeOne(conn, sid)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// 彻底删除回收站中的对象sid; WATCH回收站, 避免释放并发Undelete的对象的唯一索引值
+func (m *model) purgeOne(conn redis.Conn, sid string) (bool, error) {
+	for retry := 0; ; retry++ {
+		if _, err := conn.Do("WATCH", trashKey(m.name)); err != nil {
+			return false, err
+		}
+		obj, ok, err := m.load(conn, trashKey(m.name), sid)
+		if err != nil || !ok {
+			conn.Do("UNWATCH")
+			return false, err
+		}
+
+		t := &tx{}
+		if m.softReserve {
+			m.releaseIndexes(t, obj)
+		}
+		t.add("HDEL", trashKey(m.name), sid)
+		t.add("ZREM", trashedKey(m.name), sid)
+		t.add("ZREM", expireKey(m.name), sid)
+		_, err = t.exec(conn)
+		if err == nil {
+			return true, nil
+		}
+		if err != errWatch || retry >= maxWatchRetry {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package orr
+
+import (
+	"testing"
+)
+
+type Tsoft struct {
+	Id        int64
+	Email     string `orr:"index"`
+	Status    string `orr:"count"`
+	DeletedAt int64  `orr:"softdelete=reserve"`
+}
+
+func TestSoftDelete(t *testing.T) {
+	Register(Tsoft{})
+
+	u := &Tsoft{Email: "soft@gmail.com", Status: "new"}
+	if _, err := Insert(u, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Delete(u); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var u2 Tsoft
+	if err := Select(u.Id, "tsoft", &u2); err != ErrNotFound {
+		t.Fatal("soft deleted object should not be selected")
+	}
+	if err := SelectDeleted(u.Id, "tsoft", &u2); err != nil || u2.DeletedAt == 0 {
+		t.Fatal("soft deleted object should be in trash")
+	}
+	if counts, _ := CountsBy("tsoft", "status"); counts["new"] != 0 {
+		t.Fatal("soft deleted object should not be counted")
+	}
+	if err := Update(u, "tsoft", u.Id); err != ErrDeleted {
+		t.Fatal("update soft deleted object should return ErrDeleted")
+	}
+	// 唯一索引的值被保留
+	if _, err := Insert(&Tsoft{Email: "soft@gmail.com"}, true); err == nil {
+		t.Fatal("reserved unique value should not be reused")
+	}
+	if _, errs := InsertMany([]interface{}{&Tsoft{Email: "soft@gmail.com"}}, true); errs[0] == nil {
+		t.Fatal("reserved unique value should not be reused by InsertMany")
+	}
+	other := &Tsoft{Email: "other@gmail.com"}
+	if _, err := Insert(other, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	other.Email = "soft@gmail.com"
+	if err := Update(other, "tsoft", other.Id); err == nil {
+		t.Fatal("reserved unique value should not be used by Update")
+	}
+	// 回收站中的对象不会被查到
+	if id, _ := SelectIndex("tsoft", "email", "soft@gmail.com"); id != -1 {
+		t.Fatal("SelectIndex should not return soft deleted object")
+	}
+	if ids, err := NewQuery(Tsoft{}).Where("Email", "=", "soft@gmail.com").Ids(); err != nil || len(ids) != 0 {
+		t.Fatal("Query should not return soft deleted object")
+	}
+
+	if err := Undelete("tsoft", u.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Select(u.Id, "tsoft", &u2); err != nil || u2.DeletedAt != 0 {
+		t.Fatal("Undelete failed")
+	}
+	if id, _ := SelectIndex("tsoft", "email", "soft@gmail.com"); id != u.Id {
+		t.Fatal("Undelete should restore unique index")
+	}
+	if counts, _ := CountsBy("tsoft", "status"); counts["new"] != 1 {
+		t.Fatal("undeleted object should be counted")
+	}
+
+	Delete(u)
+	n, err := Purge("tsoft", 0)
+	if err != nil || n != 1 {
+		t.Fatal("Purge should remove 1 object")
+	}
+	if err = SelectDeleted(u.Id, "tsoft", &u2); err != ErrNotFound {
+		t.Fatal("purged object should not be in trash")
+	}
+	if id, _ := SelectIndex("tsoft", "email", "soft@gmail.com"); id != -1 {
+		t.Fatal("Purge should free reserved unique value")
+	}
+	u3 := &Tsoft{Email: "soft@gmail.com"}
+	if _, err := Insert(u3, true); err != nil {
+		t.Fatal("Purge should free reserved unique value")
+	}
+	Delete(u3)
+	Delete(other)
+	Purge("tsoft", 0)
+}
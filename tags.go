@@ -0,0 +1,149 @@
+package orr
+
+// 标签索引
+//
+// tag为tags的[]string字段, 每个标签对应一个set(结构名_字段名:tag:标签), member为obj.Id;
+// 每个对象另有一个反向set(结构名_字段名:tags:obj.Id), 保存该对象的所有标签.
+// Update时只修改增加和删除的标签.
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"reflect"
+)
+
+func tagKey(name string, fieldName string, tag string) string {
+	return redisKey(name, fieldSuffix(fieldName)+":tag:"+tag)
+}
+
+func objTagsKey(name string, fieldName string, sid string) string {
+	return redisKey(name, fieldSuffix(fieldName)+":tags:"+sid)
+}
+
+func tagValues(f *field, fv reflect.Value) ([]string, error) {
+	if !fv.IsValid() {
+		return nil, nil
+	}
+	tags, ok := fv.Interface().([]string)
+	if !ok {
+		return nil, fmt.Errorf("tags field %s must be []string type.", f.name)
+	}
+	return tags, nil
+}
+
+// 由old更新为fv时, 增加新的标签, 删除去掉的标签; old为无效值时表示新插入的对象
+func (m *model) diffTags(t *tx, f *field, sid string, old, fv reflect.Value) error {
+	oldTags, err := tagValues(f, old)
+	if err != nil {
+		return err
+	}
+	newTags, err := tagValues(f, fv)
+	if err != nil {
+		return err
+	}
+
+	oldSet := make(map[string]bool)
+	for _, tag := range oldTags {
+		oldSet[tag] = true
+	}
+	newSet := make(map[string]bool)
+	for _, tag := range newTags {
+		if newSet[tag] {
+			continue
+		}
+		newSet[tag] = true
+		if !oldSet[tag] {
+			t.add("SADD", tagKey(m.name, f.name, tag), sid)
+			t.add("SADD", objTagsKey(m.name, f.name, sid), tag)
+		}
+	}
+	for tag := range oldSet {
+		if !newSet[tag] {
+			t.add("SREM", tagKey(m.name, f.name, tag), sid)
+			t.add("SREM", objTagsKey(m.name, f.name, sid), tag)
+		}
+	}
+	return nil
+}
+
+func (m *model) removeTags(t *tx, f *field, sid string, fv reflect.Value) {
+	tags, _ := tagValues(f, fv)
+	for _, tag := range tags {
+		t.add("SREM", tagKey(m.name, f.name, tag), sid)
+	}
+	t.add("DEL", objTagsKey(m.name, f.name, sid))
+}
+
+// TaggedAny返回字段field包含任一标签的对象Id, 按Id升序
+func TaggedAny(name, field string, tags ...string) ([]int64, error) {
+	return taggedIds("SUNIONSTORE", name, field, tags)
+}
+
+// TaggedAll返回字段field包含所有标签的对象Id, 按Id升序
+func TaggedAll(name, field string, tags ...string) ([]int64, error) {
+	return taggedIds("SINTERSTORE", name, field, tags)
+}
+
+func taggedIds(cmd string, name, field string, tags []string) ([]int64, error) {
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("at least one tag is required.")
+	}
+
+	return mergeShards(func(conn redis.Conn) ([]int64, error) {
+		return tagged(conn, cmd, name, field, tags)
+	})
+}
+
+func tagged(conn redis.Conn, cmd string, name, field string, tags []string) ([]int64, error) {
+	dest := tmpKey(name)
+	args := []interface{}{dest}
+	for _, tag := range tags {
+		args = append(args, tagKey(name, field, tag))
+	}
+	conn.Send(cmd, args...)
+	conn.Send("EXPIRE", dest, tmpKeyTTL)
+	err := receiveAll(conn, 2)
+	defer conn.Do("DEL", dest)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := redis.Int64s(conn.Do("SORT", dest))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return ids, err
+}
+
+// TagsOf返回对象的所有标签
+func TagsOf(name, field string, id int64) ([]string, error) {
+	conn, err := objReadConn(name, id)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return redis.Strings(conn.Do("SMEMBERS", objTagsKey(name, field, fmt.Sprint(id))))
+}
+
+// TagCounts返回每个标签的对象数量
+func TagCounts(name, field string, tags ...string) (map[string]int64, error) {
+	conns := allConns()
+	defer closeConns(conns)
+	counts := make(map[string]int64, len(tags))
+	for _, conn := range conns {
+		for _, tag := range tags {
+			conn.Send("SCARD", tagKey(name, field, tag))
+		}
+		if err := conn.Flush(); err != nil {
+			return nil, err
+		}
+		for _, tag := range tags {
+			n, err := redis.Int64(conn.Receive())
+			if err != nil {
+				return nil, err
+			}
+			counts[tag] += n
+		}
+	}
+	return counts, nil
+}
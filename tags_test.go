@@ -0,0 +1,48 @@
+package orr
+
+import (
+	"testing"
+)
+
+type Ttags struct {
+	Id     int64
+	Labels []string `orr:"tags"`
+}
+
+func TestTags(t *testing.T) {
+	objs := []interface{}{
+		&Ttags{Labels: []string{"go", "redis"}},
+		&Ttags{Labels: []string{"go"}},
+		&Ttags{Labels: []string{"redis", "lua"}},
+	}
+	ids, errs := InsertMany(objs, false)
+	if errs[0] != nil {
+		t.Fatal(errs[0].Error())
+	}
+	defer DeleteMany(objs)
+
+	if res, err := TaggedAny("ttags", "Labels", "go", "lua"); err != nil || len(res) != 3 {
+		t.Fatal("TaggedAny returns wrong ids", res)
+	}
+	if res, _ := TaggedAll("ttags", "Labels", "go", "redis"); len(res) != 1 || res[0] != ids[0] {
+		t.Fatal("TaggedAll returns wrong ids", res)
+	}
+
+	u := objs[1].(*Ttags)
+	u.Labels = []string{"lua", "redis"}
+	if err := Update(u, "ttags", u.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	counts, err := TagCounts("ttags", "labels", "go", "redis", "lua")
+	if err != nil || counts["go"] != 1 || counts["redis"] != 3 || counts["lua"] != 2 {
+		t.Fatal("TagCounts wrong after Update", counts)
+	}
+	if tags, _ := TagsOf("ttags", "labels", u.Id); len(tags) != 2 {
+		t.Fatal("TagsOf wrong", tags)
+	}
+
+	DeleteMany(objs)
+	if counts, _ = TagCounts("ttags", "labels", "go", "redis"); counts["go"] != 0 || counts["redis"] != 0 {
+		t.Fatal("tags should be cleared on Delete")
+	}
+}
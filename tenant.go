@@ -0,0 +1,244 @@
+package orr
+
+// 多租户
+//
+// 租户的数据使用独立的key: 类型名加上租户前缀(租户@类型名), 因此主hashmap, 辅助索引,
+// KeyField, 创建时间, 过期时间等所有key及Id序列都按租户隔离:
+//   acme@tuser, acme@tuser_email, acme@tuser:created, ...
+//
+// 租户通过context传递给Context结尾的函数:
+//   ctx := orr.WithTenant(context.Background(), "acme")
+//   orr.InsertContext(ctx, &u, true)
+// 或者使用租户的Scope:
+//   s, _ := orr.ForTenant("acme")
+//   s.Insert(&u, true)
+//   id, _ := s.SelectIndex("tuser", "email", email)
+// 按类型名调用的其他函数(Search, Nearby, CountsBy等), 通过s.Name(name)得到租户的类型名.
+//
+// 租户名只能包含字母, 数字, .及-
+
+import (
+	"context"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// 每次SCAN返回的key数量
+const dropBatch = 1000
+
+var tenantRegexp = regexp.MustCompile(`^[A-Za-z0-9.-]+$`)
+
+type tenantKey struct{}
+
+// 本进程中使用过的租户, 后台清理过期对象时处理这些租户的数据
+var tenants sync.Map
+
+// WithTenant返回带有租户的context
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFrom返回context中的租户, 没有时返回空字符串
+func TenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+func checkTenant(tenant string) error {
+	if !tenantRegexp.MatchString(tenant) {
+		return fmt.Errorf("invalid tenant %q.", tenant)
+	}
+	return nil
+}
+
+// 租户的类型名
+func scopedName(tenant, name string) string {
+	if tenant == "" {
+		return name
+	}
+	return tenant + "@" + name
+}
+
+// 将租户的类型名拆分为租户及类型名
+func splitScopedName(name string) (tenant, base string) {
+	if i := strings.Index(name, "@"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// 返回租户的类型元数据, tenant为空时返回m
+func (m *model) scoped(tenant string) *model {
+	if tenant == "" {
+		return m
+	}
+	tenants.Store(tenant, true)
+	cp := *m
+	cp.name = scopedName(tenant, m.name)
+	cp.tenant = tenant
+	return &cp
+}
+
+// 按context中的租户返回类型元数据
+func (m *model) scope(ctx context.Context) (*model, error) {
+	if err := m.checkName(); err != nil {
+		return nil, err
+	}
+	tenant := TenantFrom(ctx)
+	if tenant == "" {
+		return m, nil
+	}
+	if err := checkTenant(tenant); err != nil {
+		return nil, err
+	}
+	return m.scoped(tenant), nil
+}
+
+// 不包含租户的类型名
+func (m *model) baseName() string {
+	return strings.TrimPrefix(m.name, m.tenant+"@")
+}
+
+// Scope为租户的操作入口
+type Scope struct {
+	tenant string
+}
+
+func ForTenant(tenant string) (*Scope, error) {
+	if err := checkTenant(tenant); err != nil {
+		return nil, err
+	}
+	return &Scope{tenant: tenant}, nil
+}
+
+// Context返回带有该租户的context
+func (s *Scope) Context(ctx context.Context) context.Context {
+	return WithTenant(ctx, s.tenant)
+}
+
+// Name返回租户的类型名, 用于按类型名调用的函数
+func (s *Scope) Name(name string) string {
+	tenants.Store(s.tenant, true)
+	return scopedName(s.tenant, name)
+}
+
+func (s *Scope) Insert(obj interface{}, index bool) (int64, error) {
+	return InsertContext(s.Context(context.Background()), obj, index)
+}
+
+func (s *Scope) InsertMany(objs []interface{}, index bool) ([]int64, []error) {
+	return InsertManyContext(s.Context(context.Background()), objs, index)
+}
+
+func (s *Scope) Update(obj interface{}, objName string, objId int64) error {
+	return UpdateContext(s.Context(context.Background()), obj, objName, objId)
+}
+
+func (s *Scope) Delete(obj interface{}) error {
+	return DeleteContext(s.Context(context.Background()), obj)
+}
+
+func (s *Scope) DeleteMany(objs []interface{}) []error {
+	return DeleteManyContext(s.Context(context.Background()), objs)
+}
+
+func (s *Scope) Select(Id int64, name string, res interface{}) error {
+	return Select(Id, s.Name(name), res)
+}
+
+func (s *Scope) SelectMany(ids []int64, name string, res interface{}) ([]error, error) {
+	return SelectMany(ids, s.Name(name), res)
+}
+
+func (s *Scope) SelectIndex(name, fn, value string) (int64, error) {
+	return SelectIndex(s.Name(name), fn, value)
+}
+
+func (s *Scope) InsertKeyField(typ, name string, fn string, id int64, value interface{}) error {
+	return InsertKeyField(typ, s.Name(name), fn, id, value)
+}
+
+func (s *Scope) SelectKeyField(keyTyp string, name string, fn string, id int64, res interface{}) error {
+	return SelectKeyField(keyTyp, s.Name(name), fn, id, res)
+}
+
+func (s *Scope) DeleteKeyField(typ string, name string, fn string, id int64) {
+	DeleteKeyField(typ, s.Name(name), fn, id)
+}
+
+func (s *Scope) Save(obj interface{}, fieldname string) error {
+	return save(s.tenant, obj, fieldname)
+}
+
+func (s *Scope) Restore(obj interface{}, fieldname string) error {
+	return restore(s.tenant, obj, fieldname)
+}
+
+// NewQuery创建租户的查询
+func (s *Scope) NewQuery(obj interface{}) *Query {
+	q := NewQuery(obj)
+	if q.err == nil {
+		q.m = q.m.scoped(s.tenant)
+	}
+	return q
+}
+
+// DropTenant删除租户的所有数据
+func DropTenant(tenant string) error {
+	if err := checkTenant(tenant); err != nil {
+		return err
+	}
+
+	// 集群模式及客户端分片时需要遍历每个节点
+	var conns []redis.Conn
+	if c, ok := rpool.(*Cluster); ok {
+		conns = c.nodeConns()
+	} else {
+		conns = allConns()
+	}
+	defer closeConns(conns)
+
+	pattern := redisKey(scopedName(tenant, "*"), "*")
+	for _, conn := range conns {
+		if err := dropKeys(conn, pattern); err != nil {
+			return err
+		}
+	}
+
+	resetIds(tenant + "@")
+	tenants.Delete(tenant)
+	return nil
+}
+
+// 删除匹配pattern的所有key
+// 集群中不同类型的key不在同一个slot中, 因此逐个DEL
+func dropKeys(conn redis.Conn, pattern string) error {
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", dropBatch))
+		if err != nil {
+			return err
+		}
+		if cursor, err = redis.String(reply[0], nil); err != nil {
+			return err
+		}
+		keys, err := redis.Values(reply[1], nil)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			conn.Send("DEL", key)
+		}
+		if len(keys) > 0 {
+			if _, err = conn.Do(""); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package orr
+
+import (
+	"context"
+	"testing"
+)
+
+type Ttenant struct {
+	Id    int64
+	Email string `orr:"index"`
+	Notes []string
+}
+
+func TestTenant(t *testing.T) {
+	a, err := ForTenant("acme")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, _ := ForTenant("globex")
+	if _, err = ForTenant("bad@tenant"); err == nil {
+		t.Fatal("invalid tenant should be rejected")
+	}
+
+	ua := &Ttenant{Email: "same@example.com"}
+	if _, err = a.Insert(ua, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	ub := &Ttenant{Email: "same@example.com"}
+	ctx := WithTenant(context.Background(), "globex")
+	if _, err = InsertContext(ctx, ub, true); err != nil {
+		t.Fatal("the same unique value should be allowed in another tenant: " + err.Error())
+	}
+	if ua.Id != 1 || ub.Id != 1 {
+		t.Fatal("each tenant should have its own id sequence")
+	}
+	if id, _ := SelectIndex("ttenant", "email", "same@example.com"); id != -1 {
+		t.Fatal("tenant data should not be visible without tenant")
+	}
+
+	if err = a.InsertKeyField("hash", "ttenant", "extra", ua.Id, "acme extra"); err != nil {
+		t.Fatal(err.Error())
+	}
+	var extra string
+	b.SelectKeyField("hash", "ttenant", "extra", ub.Id, &extra)
+	if extra != "" {
+		t.Fatal("KeyField should be isolated by tenant")
+	}
+
+	if err = DropTenant("acme"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if id, _ := a.SelectIndex("ttenant", "email", "same@example.com"); id != -1 {
+		t.Fatal("DropTenant should remove index of the tenant")
+	}
+	var u Ttenant
+	if err = a.Select(ua.Id, "ttenant", &u); err != ErrNotFound {
+		t.Fatal("DropTenant should remove objects of the tenant")
+	}
+	if id, _ := b.SelectIndex("ttenant", "email", "same@example.com"); id != ub.Id {
+		t.Fatal("DropTenant should not affect other tenants")
+	}
+	if err = b.Select(ub.Id, "ttenant", &u); err != nil || u.Email != "same@example.com" {
+		t.Fatal("DropTenant should not affect other tenants")
+	}
+
+	// 租户名可以包含-
+	c, err := ForTenant("my-co")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	uc := &Ttenant{Email: "c@example.com", Notes: []string{"n1"}}
+	if _, err = c.Insert(uc, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = c.Save(uc, "Notes"); err != nil {
+		t.Fatal(err.Error())
+	}
+	rc := &Ttenant{Id: uc.Id}
+	if err = c.Restore(rc, "Notes"); err != nil || len(rc.Notes) != 1 {
+		t.Fatal("Restore in tenant my-co failed")
+	}
+	DropTenant("my-co")
+}
@@ -0,0 +1,282 @@
+package orr
+
+// 全文索引
+//
+// tag为text的string字段被切分为token, 每个token对应一个set(结构名:text:token), member为obj.Id;
+// 英文及数字的token还为其前缀建立set(结构名:textp:前缀), 用于前缀匹配.
+// 中日韩文字没有分隔符, 每个字及相邻两个字都作为token.
+//
+// Search的查询语法:
+//   空格分隔的词之间为AND关系: "tie gmail"
+//   | 或 OR 分隔的组之间为OR关系: "tie | guo"
+//   以*结尾的词为前缀匹配: "gu*"
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"unicode"
+)
+
+// 前缀索引的最大长度
+const maxTextPrefix = 10
+
+func textKey(name, token string) string {
+	return redisKey(name, ":text:"+token)
+}
+
+func textPrefixKey(name, prefix string) string {
+	return redisKey(name, ":textp:"+prefix)
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
+
+// 将文本切分为词, 中日韩文字连续的部分作为一个词
+func splitWords(s string) (words []string, cjk []bool) {
+	var (
+		cur   []rune
+		inCJK bool
+	)
+	flush := func() {
+		if len(cur) > 0 {
+			words = append(words, string(cur))
+			cjk = append(cjk, inCJK)
+			cur = cur[:0]
+		}
+	}
+
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case isCJK(r):
+			if !inCJK {
+				flush()
+				inCJK = true
+			}
+			cur = append(cur, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if inCJK {
+				flush()
+				inCJK = false
+			}
+			cur = append(cur, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	return words, cjk
+}
+
+// 索引使用的token及前缀
+func textTokens(s string) (tokens []string, prefixes []string) {
+	seen := make(map[string]bool)
+	seenPrefix := make(map[string]bool)
+	addToken := func(tok string) {
+		if !seen[tok] {
+			seen[tok] = true
+			tokens = append(tokens, tok)
+		}
+	}
+
+	words, cjk := splitWords(s)
+	for i, w := range words {
+		rs := []rune(w)
+		if !cjk[i] {
+			addToken(w)
+			for n := 1; n < len(rs) && n <= maxTextPrefix; n++ {
+				p := string(rs[:n])
+				if !seenPrefix[p] {
+					seenPrefix[p] = true
+					prefixes = append(prefixes, p)
+				}
+			}
+			continue
+		}
+
+		for j := range rs {
+			addToken(string(rs[j]))
+			if j+1 < len(rs) {
+				addToken(string(rs[j : j+2]))
+			}
+		}
+	}
+
+	return tokens, prefixes
+}
+
+// 查询词对应的索引key, 每一项中的key取并集, 各项之间取交集
+func queryKeys(name, term string) [][]interface{} {
+	var keys [][]interface{}
+
+	prefix := strings.HasSuffix(term, "*")
+	words, cjk := splitWords(strings.TrimSuffix(term, "*"))
+	for i, w := range words {
+		rs := []rune(w)
+		switch {
+		case cjk[i] && len(rs) == 1:
+			keys = append(keys, []interface{}{textKey(name, w)})
+		case cjk[i]:
+			for j := 0; j+1 < len(rs); j++ {
+				keys = append(keys, []interface{}{textKey(name, string(rs[j:j+2]))})
+			}
+		case prefix && i == len(words)-1:
+			// 超过前缀索引长度时, 用最长的前缀近似
+			if len(rs) > maxTextPrefix {
+				rs = rs[:maxTextPrefix]
+			}
+			// 前缀索引不包含完整的词本身
+			keys = append(keys, []interface{}{textPrefixKey(name, string(rs)), textKey(name, string(rs))})
+		default:
+			keys = append(keys, []interface{}{textKey(name, w)})
+		}
+	}
+	return keys
+}
+
+func (m *model) addText(t *tx, sid string, value string) {
+	tokens, prefixes := textTokens(value)
+	for _, tok := range tokens {
+		t.add("SADD", textKey(m.name, tok), sid)
+	}
+	for _, p := range prefixes {
+		t.add("SADD", textPrefixKey(m.name, p), sid)
+	}
+}
+
+func (m *model) removeText(t *tx, sid string, value string) {
+	tokens, prefixes := textTokens(value)
+	for _, tok := range tokens {
+		t.add("SREM", textKey(m.name, tok), sid)
+	}
+	for _, p := range prefixes {
+		t.add("SREM", textPrefixKey(m.name, p), sid)
+	}
+}
+
+// Search在类型name的全文索引中查询, 结果按Id升序追加到res中
+// limit为0时返回所有结果
+func Search(name string, query string, limit int, res interface{}) error {
+	rtelem, isPtr, err := resultElem(res)
+	if err != nil {
+		return err
+	}
+
+	conns := allConns()
+	defer closeConns(conns)
+	hits, err := searchHits(conns, name, query, limit)
+	if err != nil || len(hits) == 0 {
+		return err
+	}
+	replies, err := hmgetHits(conns, name, hits)
+	if err != nil {
+		return err
+	}
+	return appendObjects(replies, res, rtelem, isPtr)
+}
+
+// SearchIds与Search相同, 仅返回对象Id
+func SearchIds(name string, query string, limit int) ([]int64, error) {
+	conns := allConns()
+	defer closeConns(conns)
+	hits, err := searchHits(conns, name, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	return hitIds(hits), nil
+}
+
+// 在每个分片中查询, 合并后按Id升序取前limit个
+func searchHits(conns []redis.Conn, name string, query string, limit int) ([]hit, error) {
+	lists := make([][]hit, len(conns))
+	for i, conn := range conns {
+		ids, err := searchIds(conn, name, query, limit)
+		if err != nil {
+			return nil, err
+		}
+		lists[i] = idHits(ids, i)
+	}
+	return mergeHits(lists, false, 0, limit), nil
+}
+
+func searchIds(conn redis.Conn, name string, query string, limit int) ([]interface{}, error) {
+	var (
+		groups [][]string
+		cur    []string
+		tmps   []interface{}
+	)
+	for _, term := range strings.Fields(query) {
+		if term == "|" || term == "OR" {
+			if len(cur) > 0 {
+				groups = append(groups, cur)
+			}
+			cur = nil
+			continue
+		}
+		cur = append(cur, term)
+	}
+	if len(cur) > 0 {
+		groups = append(groups, cur)
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("search query is empty.")
+	}
+
+	defer func() {
+		if len(tmps) > 0 {
+			conn.Do("DEL", tmps...)
+		}
+	}()
+	newTmp := func() string {
+		k := tmpKey(name)
+		tmps = append(tmps, k)
+		return k
+	}
+
+	// 每组内各词取交集, 组之间取并集
+	n := 0
+	var groupKeys []interface{}
+	for _, group := range groups {
+		var keys []interface{}
+		for _, term := range group {
+			for _, union := range queryKeys(name, term) {
+				if len(union) == 1 {
+					keys = append(keys, union[0])
+					continue
+				}
+				k := newTmp()
+				conn.Send("SUNIONSTORE", append([]interface{}{k}, union...)...)
+				conn.Send("EXPIRE", k, tmpKeyTTL)
+				n += 2
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		dest := newTmp()
+		conn.Send("SINTERSTORE", append([]interface{}{dest}, keys...)...)
+		conn.Send("EXPIRE", dest, tmpKeyTTL)
+		n += 2
+		groupKeys = append(groupKeys, dest)
+	}
+	if len(groupKeys) == 0 {
+		return nil, nil
+	}
+
+	dest := newTmp()
+	conn.Send("SUNIONSTORE", append([]interface{}{dest}, groupKeys...)...)
+	conn.Send("EXPIRE", dest, tmpKeyTTL)
+	if err := receiveAll(conn, n+2); err != nil {
+		return nil, err
+	}
+
+	args := []interface{}{dest}
+	if limit > 0 {
+		args = append(args, "LIMIT", 0, limit)
+	}
+	return redis.Values(conn.Do("SORT", args...))
+}
@@ -0,0 +1,60 @@
+package orr
+
+import (
+	"testing"
+)
+
+type Ttext struct {
+	Id    int64
+	Name  string `orr:"text"`
+	Email string `orr:"text"`
+}
+
+func TestSearch(t *testing.T) {
+	objs := []interface{}{
+		&Ttext{Name: "铁哥", Email: "tiege@gmail.com"},
+		&Ttext{Name: "guotie", Email: "guotie@163.com"},
+		&Ttext{Name: "Gu Ying", Email: "gy@gmail.com"},
+	}
+	ids, errs := InsertMany(objs, false)
+	if errs[0] != nil {
+		t.Fatal(errs[0].Error())
+	}
+	defer DeleteMany(objs)
+
+	cases := []struct {
+		query string
+		n     int
+	}{
+		{"铁哥", 1},
+		{"铁", 1},
+		{"gmail", 2},
+		{"gu*", 2},
+		{"gu* gmail", 1},
+		{"铁哥 | guotie", 2},
+		{"nobody", 0},
+	}
+	for _, c := range cases {
+		res, err := SearchIds("ttext", c.query, 0)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(res) != c.n {
+			t.Fatalf("search %s: expect %d results, got %v", c.query, c.n, res)
+		}
+	}
+
+	u := objs[1].(*Ttext)
+	u.Name = "tieguo"
+	if err := Update(u, "ttext", ids[1]); err != nil {
+		t.Fatal(err.Error())
+	}
+	if res, _ := SearchIds("ttext", "guotie", 0); len(res) != 1 {
+		t.Fatal("old tokens should be removed on Update")
+	}
+
+	var found []Ttext
+	if err := Search("ttext", "tie*", 1, &found); err != nil || len(found) != 1 {
+		t.Fatal("Search with limit failed")
+	}
+}
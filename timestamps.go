@@ -0,0 +1,160 @@
+package orr
+
+// 自动时间戳及默认值
+//
+//   created: Insert时设置为当前时间
+//   updated: Insert及Update时设置为当前时间
+//   default=值: Insert时零值字段设置为该值
+// created及updated字段必须为time.Time或int64(unix时间, 秒).
+// 默认值按字段类型解析: 数值, bool, string, time.Duration("1h"), time.Time(RFC3339或now),
+// 其他类型(slice, map, struct)按json解析: `orr:"default=[\"a\",\"b\"]"`
+//
+// 当前时间由时钟函数返回, 测试时可以通过SetClock替换
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+var clock = struct {
+	sync.RWMutex
+	now func() time.Time
+}{now: time.Now}
+
+// SetClock替换orr使用的时钟, 影响时间戳字段, 创建时间, 过期时间, 软删除及历史版本的时间
+// clock为nil时恢复为time.Now
+func SetClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	clock.Lock()
+	clock.now = now
+	clock.Unlock()
+}
+
+func now() time.Time {
+	clock.RLock()
+	defer clock.RUnlock()
+	return clock.now()
+}
+
+// 设置时间字段, tm为零值时int64字段设置为0
+func setTime(f *field, rv reflect.Value, tm time.Time) error {
+	fv := rv.Field(f.index)
+	switch {
+	case f.typ == timeType:
+		fv.Set(reflect.ValueOf(tm))
+	case fv.Kind() == reflect.Int64:
+		if tm.IsZero() {
+			fv.SetInt(0)
+		} else {
+			fv.SetInt(tm.Unix())
+		}
+	default:
+		return fmt.Errorf("time field %s must be int64 or time.Time.", f.name)
+	}
+	return nil
+}
+
+func isZero(fv reflect.Value) bool {
+	return reflect.DeepEqual(fv.Interface(), reflect.Zero(fv.Type()).Interface())
+}
+
+// Insert之前设置默认值及时间戳; 已设置的created字段保持不变
+func (m *model) prepareInsert(rv reflect.Value) error {
+	tm := now()
+	for _, f := range m.fields {
+		fv := rv.Field(f.index)
+		if v, ok := f.opts["default"]; ok && isZero(fv) {
+			if err := setDefault(fv, v); err != nil {
+				return fmt.Errorf("default value of field %s: %s", f.name, err.Error())
+			}
+		}
+		if f.has("created") && isZero(fv) || f.has("updated") {
+			if err := setTime(f, rv, tm); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Update之前设置时间戳; created字段为零值时使用old中的值, old为redis中保存的对象
+func (m *model) prepareUpdate(rv reflect.Value, old reflect.Value) error {
+	tm := now()
+	for _, f := range m.fields {
+		if f.has("created") && old.IsValid() && isZero(rv.Field(f.index)) {
+			rv.Field(f.index).Set(old.Field(f.index))
+		}
+		if f.has("updated") {
+			if err := setTime(f, rv, tm); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setDefault(fv reflect.Value, s string) error {
+	if fv.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+		return nil
+	}
+	if fv.Type() == timeType {
+		if s == "now" {
+			fv.Set(reflect.ValueOf(now()))
+			return nil
+		}
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return err
+		}
+		fv.Set(reflect.ValueOf(tm))
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(n)
+	default:
+		return json.Unmarshal([]byte(s), fv.Addr().Interface())
+	}
+	return nil
+}
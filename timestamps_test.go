@@ -0,0 +1,52 @@
+package orr
+
+import (
+	"testing"
+	"time"
+)
+
+type Ttimestamp struct {
+	Id        int64
+	Name      string
+	Role      string        `orr:"default=member"`
+	Quota     int           `orr:"default=10"`
+	Period    time.Duration `orr:"default=1h"`
+	Tags      []string      `orr:"default=[\"new\"]"`
+	CreatedAt time.Time     `orr:"created"`
+	UpdatedAt int64         `orr:"updated"`
+}
+
+func TestTimestamps(t *testing.T) {
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	SetClock(func() time.Time { return t1 })
+	defer SetClock(nil)
+
+	obj := &Ttimestamp{Name: "ts", Quota: 3}
+	if _, err := Insert(obj, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	var o Ttimestamp
+	if err := Select(obj.Id, "ttimestamp", &o); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !o.CreatedAt.Equal(t1) || o.UpdatedAt != t1.Unix() {
+		t.Fatalf("timestamps not set on insert: %+v", o)
+	}
+	if o.Role != "member" || o.Quota != 3 || o.Period != time.Hour ||
+		len(o.Tags) != 1 || o.Tags[0] != "new" {
+		t.Fatalf("default values not applied: %+v", o)
+	}
+
+	// Update时保留创建时间
+	t2 := t1.Add(time.Hour)
+	SetClock(func() time.Time { return t2 })
+	if err := Update(&Ttimestamp{Id: o.Id, Name: "ts2"}, "ttimestamp", o.Id); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Select(obj.Id, "ttimestamp", &o); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !o.CreatedAt.Equal(t1) || o.UpdatedAt != t2.Unix() || o.Name != "ts2" {
+		t.Fatalf("timestamps not set on update: %+v", o)
+	}
+}
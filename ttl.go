@@ -0,0 +1,258 @@
+package orr
+
+// 对象过期
+//
+// 所有对象保存在同一个类型的hashmap中, 无法对单个对象设置redis的过期时间,
+// 因此过期时间保存在zset(结构名:expire)中, score为过期时间(毫秒), member为obj.Id.
+// StartReaper启动的后台goroutine定期清理已过期的对象, 清理时删除主hashmap中的数据,
+// 所有辅助索引(唯一索引, 集合, 范围, 全文, 标签等)及该对象的KeyField.
+// 已过期但尚未清理的对象, Select, SelectMany, SelectIndex, List, ListOrdered,
+// Query.Find, Search及Nearby视为不存在; 只返回id的Query.Ids, SearchIds, 计数及标签查询
+// 在清理之前仍包含这些对象, Limit按包含过期对象的结果计算.
+// Save保存的字段也作为KeyField记录, 过期时一并删除.
+//
+// 类型的默认存活时间通过Register(obj, WithTTL(d))设置, 单个对象通过Expire设置.
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"time"
+)
+
+// 每次清理每个类型最多处理的对象数
+const reapBatch = 100
+
+func expireKey(name string) string {
+	return redisKey(name, ":expire")
+}
+
+// 记录类型的KeyField, member为 typ:fn
+func keyFieldsKey(name string) string {
+	return redisKey(name, ":keyfields")
+}
+
+func nowMillis() int64 {
+	return now().UnixNano() / int64(time.Millisecond)
+}
+
+func expireScore(ttl time.Duration) int64 {
+	return nowMillis() + int64(ttl/time.Millisecond)
+}
+
+// 对象ids是否已过期
+func expiredFlags(conn redis.Conn, name string, ids []interface{}) ([]bool, error) {
+	// 没有发送命令时Do("")返回nil
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	for _, id := range ids {
+		conn.Send("ZSCORE", expireKey(name), id)
+	}
+	scores, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	flags := make([]bool, len(ids))
+	for i := range ids {
+		flags[i] = i < len(scores) && expired(scores[i])
+	}
+	return flags, nil
+}
+
+// 通过HMGET读取ids对应的对象, 已过期但尚未清理的对象返回nil
+func hmgetLive(conn redis.Conn, name string, ids []interface{}) ([]interface{}, error) {
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, hashKey(name))
+	args = append(args, ids...)
+	conn.Send("HMGET", args...)
+	for _, id := range ids {
+		conn.Send("ZSCORE", expireKey(name), id)
+	}
+	all, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	replies, err := redis.Values(all[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := range replies {
+		if expired(all[i+1]) {
+			replies[i] = nil
+		}
+	}
+	return replies, nil
+}
+
+// ZSCORE的返回是否表示已过期
+func expired(score interface{}) bool {
+	if score == nil {
+		return false
+	}
+	deadline, err := redis.Int64(score, nil)
+	if err != nil {
+		f, err := redis.Float64(score, nil)
+		if err != nil {
+			return false
+		}
+		deadline = int64(f)
+	}
+	return deadline <= nowMillis()
+}
+
+// Expire设置对象在ttl之后过期
+func Expire(name string, id int64, ttl time.Duration) error {
+	conn, err := objConn(name, id)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("ZADD", expireKey(name), expireScore(ttl), id)
+	return err
+}
+
+// Persist取消对象的过期时间
+func Persist(name string, id int64) error {
+	conn, err := objConn(name, id)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("ZREM", expireKey(name), id)
+	return err
+}
+
+// TTL返回对象的剩余存活时间, 没有设置过期时间时返回-1
+func TTL(name string, id int64) (time.Duration, error) {
+	conn, err := objConn(name, id)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	deadline, err := redis.Int64(conn.Do("ZSCORE", expireKey(name), id))
+	if err == redis.ErrNil {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	d := time.Duration(deadline-nowMillis()) * time.Millisecond
+	if d < 0 {
+		d = 0
+	}
+	return d, nil
+}
+
+// StartReaper启动清理过期对象的goroutine, 每interval检查一次所有已注册的类型
+// 返回的函数用于停止清理
+func StartReaper(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for _, m := range allModels() {
+					ReapExpired(m.name)
+					tenants.Range(func(tenant, _ interface{}) bool {
+						ReapExpired(scopedName(tenant.(string), m.name))
+						return true
+					})
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// ReapExpired清理类型name中已过期的对象, 返回清理的对象数
+func ReapExpired(name string) (int, error) {
+	m, ok := modelByName(name)
+	if !ok {
+		return 0, nil
+	}
+
+	conns := allConns()
+	defer closeConns(conns)
+
+	n := 0
+	for _, conn := range conns {
+		for {
+			sids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", expireKey(name),
+				"-inf", nowMillis(), "LIMIT", 0, reapBatch))
+			if err != nil {
+				return n, err
+			}
+			for _, sid := range sids {
+				ok, err := m.expire(conn, sid)
+				if err != nil {
+					return n, err
+				}
+				if ok {
+					n++
+				}
+			}
+			if len(sids) < reapBatch {
+				break
+			}
+		}
+	}
+	return n, nil
+}
+
+// 删除一个已过期的对象; 对象的过期时间被修改或已不存在时返回false
+func (m *model) expire(conn redis.Conn, sid string) (bool, error) {
+	for retry := 0; ; retry++ {
+		if _, err := conn.Do("WATCH", hashKey(m.name), expireKey(m.name)); err != nil {
+			return false, err
+		}
+		score, err := conn.Do("ZSCORE", expireKey(m.name), sid)
+		if err != nil || !expired(score) {
+			conn.Do("UNWATCH")
+			return false, err
+		}
+		keyfields, err := redis.Strings(conn.Do("SMEMBERS", keyFieldsKey(m.name)))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return false, err
+		}
+
+		t := &tx{}
+		old, ok, err := m.load(conn, hashKey(m.name), sid)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return false, err
+		}
+		if ok {
+			m.purgeCommands(t, sid, old)
+		} else {
+			t.add("ZREM", expireKey(m.name), sid)
+		}
+		for _, kf := range keyfields {
+			parts := strings.SplitN(kf, ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			switch parts[0] {
+			case "key":
+				t.add("DEL", keyFieldKey(m.name, parts[1], sid))
+			case "hash":
+				t.add("HDEL", keyFieldHashKey(m.name, parts[1]), sid)
+			}
+		}
+
+		_, err = t.exec(conn)
+		if err == nil {
+			return ok, nil
+		}
+		if err != errWatch || retry >= maxWatchRetry {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package orr
+
+import (
+	"testing"
+	"time"
+)
+
+type Tttl struct {
+	Id    int64
+	Token string `orr:"index"`
+	Notes []string
+}
+
+type Tttlempty struct {
+	Id int64
+}
+
+func TestExpire(t *testing.T) {
+	if err := Register(&Tttl{}, WithTTL(50*time.Millisecond)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	u := &Tttl{Token: "t1"}
+	if _, err := Insert(u, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := InsertKeyField("hash", "tttl", "extra", u.Id, []int{1, 2}); err != nil {
+		t.Fatal(err.Error())
+	}
+	u.Notes = []string{"saved"}
+	if err := Save(u, "Notes"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if d, err := TTL("tttl", u.Id); err != nil || d <= 0 {
+		t.Fatal("TTL should be positive")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	var u2 Tttl
+	if err := Select(u.Id, "tttl", &u2); err != ErrNotFound {
+		t.Fatal("expired object should not be found")
+	}
+	if id, _ := SelectIndex("tttl", "token", "t1"); id != -1 {
+		t.Fatal("expired object should not be found by index")
+	}
+	var all []Tttl
+	if _, err := List("tttl", 0, 100, &all); err != nil || len(all) != 0 {
+		t.Fatal("expired object should not be listed")
+	}
+	var none []Tttlempty
+	if _, err := List("tttlempty", 0, 100, &none); err != nil || len(none) != 0 {
+		t.Fatal("List of an empty type should return no object")
+	}
+
+	n, err := ReapExpired("tttl")
+	if err != nil || n != 1 {
+		t.Fatal("ReapExpired should remove 1 object")
+	}
+	if id, _ := SelectIndex("tttl", "token", "t1"); id != -1 {
+		t.Fatal("index should be removed with expired object")
+	}
+	var extra []int
+	SelectKeyField("hash", "tttl", "extra", u.Id, &extra)
+	if len(extra) != 0 {
+		t.Fatal("KeyField should be removed with expired object")
+	}
+	if err := Restore(&Tttl{Id: u.Id}, "Notes"); err == nil {
+		t.Fatal("saved field should be removed with expired object")
+	}
+
+	// Persist之后不再过期
+	u = &Tttl{Token: "t2"}
+	Insert(u, true)
+	defer Delete(u)
+	Persist("tttl", u.Id)
+	if d, _ := TTL("tttl", u.Id); d != -1 {
+		t.Fatal("Persist failed")
+	}
+}
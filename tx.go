@@ -0,0 +1,102 @@
+package orr
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+)
+
+// WATCH的key被修改时, 事务最多重试的次数
+const maxWatchRetry = 5
+
+var errWatch = errors.New("transaction aborted, watched key has been modified.")
+
+type command struct {
+	name string
+	args []interface{}
+}
+
+// tx收集一次写操作涉及的所有命令, 在MULTI/EXEC中执行
+type tx struct {
+	cmds []command
+	sent int   // send实际发送的命令数, 包括MULTI, EXEC或DISCARD
+	err  error // send失败的原因
+}
+
+func (t *tx) add(name string, args ...interface{}) {
+	t.cmds = append(t.cmds, command{name, args})
+}
+
+// 发送MULTI, 所有命令及EXEC, 不等待返回
+// 部分命令发送失败时(如集群中的key不在同一个slot), 以DISCARD结束事务, receive读取已发送命令的返回后返回错误
+func (t *tx) send(conn redis.Conn) error {
+	t.sent, t.err = 0, nil
+	if err := conn.Send("MULTI"); err != nil {
+		t.err = err
+		return err
+	}
+	t.sent++
+	for _, c := range t.cmds {
+		if err := conn.Send(c.name, c.args...); err != nil {
+			t.discard(conn, err)
+			return err
+		}
+		t.sent++
+	}
+	if err := conn.Send("EXEC"); err != nil {
+		t.discard(conn, err)
+		return err
+	}
+	t.sent++
+	return nil
+}
+
+func (t *tx) discard(conn redis.Conn, err error) {
+	t.err = err
+	if conn.Send("DISCARD") == nil {
+		t.sent++
+	}
+}
+
+// 读取send的返回, 返回EXEC中每个命令的结果
+func (t *tx) receive(conn redis.Conn) ([]interface{}, error) {
+	if t.err != nil {
+		for i := 0; i < t.sent; i++ {
+			conn.Receive()
+		}
+		return nil, t.err
+	}
+	var err error
+	for i := 0; i <= len(t.cmds); i++ {
+		if _, e := conn.Receive(); e != nil && err == nil {
+			err = e
+		}
+	}
+	replies, e := redis.Values(conn.Receive())
+	if err != nil {
+		return nil, err
+	}
+	if e == redis.ErrNil {
+		return nil, errWatch
+	}
+	if e != nil {
+		return nil, e
+	}
+	for i, reply := range replies {
+		if e, ok := reply.(redis.Error); ok {
+			return replies, fmt.Errorf("%s failed: %s", t.cmds[i].name, e.Error())
+		}
+	}
+	return replies, nil
+}
+
+func (t *tx) exec(conn redis.Conn) ([]interface{}, error) {
+	if len(t.cmds) == 0 {
+		return nil, nil
+	}
+	t.send(conn)
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	return t.receive(conn)
+}
@@ -0,0 +1,170 @@
+package orr
+
+// 字段校验
+//
+// valid tag定义字段的约束, Insert, InsertMany及Update在写入redis之前校验:
+//   not null, required: 不能为零值
+//   minlen:n, maxlen:n: string(按字符计算), slice, map的长度
+//   min:n, max:n:       数值的范围
+//   regexp:表达式:      string必须匹配表达式, 表达式中不能包含;
+//   enum:a|b|c:         值必须为其中之一
+//   email:              string必须为email地址
+// 零值的字段不校验minlen, maxlen, regexp, email; min, max, enum对零值同样校验.
+//  example: `valid:"not null;maxlen:20;regexp:^[a-z0-9_]+$"`
+//
+// 校验失败时返回ValidationError, 包含所有不符合约束的字段
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var emailRegexp = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// 字段的校验规则
+type rules struct {
+	opts map[string]string
+	re   *regexp.Regexp
+	err  error // tag定义错误
+}
+
+func parseRules(tag string) *rules {
+	opts := parseTag(tag)
+	if len(opts) == 0 {
+		return nil
+	}
+	r := &rules{opts: opts}
+	if expr, ok := opts["REGEXP"]; ok {
+		r.re, r.err = regexp.Compile(expr)
+	}
+	for _, k := range []string{"MINLEN", "MAXLEN", "MIN", "MAX"} {
+		if v, ok := opts[k]; ok && r.err == nil {
+			_, r.err = strconv.ParseFloat(v, 64)
+		}
+	}
+	return r
+}
+
+// FieldError为一个字段违反的约束
+type FieldError struct {
+	Field   string
+	Rule    string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("field %s %s", e.Field, e.Message)
+}
+
+// ValidationError包含所有校验失败的字段
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Error()
+	}
+	return "validation failed: " + strings.Join(msgs, "; ") + "."
+}
+
+// Validate按valid tag校验对象, obj为struct或struct的Ptr
+func Validate(obj interface{}) error {
+	rv := reflect.Indirect(reflect.ValueOf(obj))
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("Param obj must be struct type.")
+	}
+	return getModel(rv.Type()).validate(rv)
+}
+
+func (m *model) validate(rv reflect.Value) error {
+	var errs ValidationError
+	for _, f := range m.fields {
+		if f.rules == nil {
+			continue
+		}
+		if f.rules.err != nil {
+			return fmt.Errorf("valid tag of field %s: %s", f.name, f.rules.err.Error())
+		}
+		errs = append(errs, f.validate(rv.Field(f.index))...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (f *field) validate(fv reflect.Value) (errs []FieldError) {
+	opts := f.rules.opts
+	fail := func(rule string, format string, args ...interface{}) {
+		errs = append(errs, FieldError{f.name, rule, fmt.Sprintf(format, args...)})
+	}
+
+	zero := isZero(fv)
+	if zero {
+		if _, ok := opts["NOT NULL"]; ok {
+			fail("NOT NULL", "is required")
+		} else if _, ok := opts["REQUIRED"]; ok {
+			fail("REQUIRED", "is required")
+		}
+	}
+
+	if n, ok := length(fv); ok && !zero {
+		if v, ok := opts["MINLEN"]; ok && float64(n) < atof(v) {
+			fail("MINLEN", "length must be at least %s", v)
+		}
+		if v, ok := opts["MAXLEN"]; ok && float64(n) > atof(v) {
+			fail("MAXLEN", "length must be at most %s", v)
+		}
+	}
+	if fv.Type() != timeType {
+		if n, err := scoreOf(fv.Interface()); err == nil {
+			if v, ok := opts["MIN"]; ok && n < atof(v) {
+				fail("MIN", "must be at least %s", v)
+			}
+			if v, ok := opts["MAX"]; ok && n > atof(v) {
+				fail("MAX", "must be at most %s", v)
+			}
+		}
+	}
+	if fv.Kind() == reflect.String && !zero {
+		if f.rules.re != nil && !f.rules.re.MatchString(fv.String()) {
+			fail("REGEXP", "must match %s", f.rules.re.String())
+		}
+		if _, ok := opts["EMAIL"]; ok && !emailRegexp.MatchString(fv.String()) {
+			fail("EMAIL", "must be an email address")
+		}
+	}
+	if v, ok := opts["ENUM"]; ok {
+		found := false
+		s := valueString(fv)
+		for _, e := range strings.Split(v, "|") {
+			if strings.TrimSpace(e) == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("ENUM", "must be one of %s", v)
+		}
+	}
+	return
+}
+
+func length(fv reflect.Value) (int, bool) {
+	switch fv.Kind() {
+	case reflect.String:
+		return utf8.RuneCountInString(fv.String()), true
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return fv.Len(), true
+	}
+	return 0, false
+}
+
+func atof(s string) float64 {
+	n, _ := strconv.ParseFloat(s, 64)
+	return n
+}
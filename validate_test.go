@@ -0,0 +1,52 @@
+package orr
+
+import (
+	"testing"
+)
+
+type Tvalid struct {
+	Id     int64
+	Name   string   `valid:"not null;minlen:2;maxlen:8;regexp:^[a-z]+$"`
+	Email  string   `valid:"email"`
+	Age    int      `valid:"min:1;max:150"`
+	Role   string   `valid:"enum:admin|member"`
+	Labels []string `valid:"maxlen:2"`
+}
+
+func TestValidate(t *testing.T) {
+	v := &Tvalid{Name: "X", Email: "bad", Age: 200, Role: "root", Labels: []string{"a", "b", "c"}}
+	_, err := Insert(v, false)
+	verr, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("Insert should return ValidationError, got %v", err)
+	}
+	rules := map[string]bool{}
+	for _, fe := range verr {
+		rules[fe.Field+":"+fe.Rule] = true
+	}
+	for _, r := range []string{"Name:MINLEN", "Name:REGEXP", "Email:EMAIL", "Age:MAX", "Role:ENUM", "Labels:MAXLEN"} {
+		if !rules[r] {
+			t.Fatalf("violation %s should be reported: %s", r, err.Error())
+		}
+	}
+
+	// 零值不校验长度及格式, 但要校验min及enum
+	err = Validate(&Tvalid{})
+	verr, _ = err.(ValidationError)
+	rules = map[string]bool{}
+	for _, fe := range verr {
+		rules[fe.Field+":"+fe.Rule] = true
+	}
+	if !rules["Name:NOT NULL"] || !rules["Age:MIN"] || !rules["Role:ENUM"] || rules["Email:EMAIL"] || len(verr) != 3 {
+		t.Fatalf("zero values are validated wrongly: %v", err)
+	}
+
+	v = &Tvalid{Name: "tie", Email: "g@gmail.com", Age: 30, Role: "admin"}
+	if _, err = Insert(v, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	v.Role = "owner"
+	if err = Update(v, "tvalid", v.Id); err == nil {
+		t.Fatal("Update should validate")
+	}
+}